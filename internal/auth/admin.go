@@ -0,0 +1,721 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/labstack/echo/v4"
+)
+
+// User administration errors
+var (
+	ErrUserInactive   = errors.New("user is deactivated")
+	ErrSelfDeactivate = errors.New("you cannot deactivate your own account")
+	ErrRoleForbidden  = errors.New("assigning this role requires the roles:manage permission")
+	ErrOutranked      = errors.New("this user has access you do not have")
+)
+
+// Page sizes for the admin user list
+const (
+	defaultUsersPerPage = 25
+	maxUsersPerPage     = 100
+)
+
+// Escapes LIKE wildcards so a search matches literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// UserFilter selects a page of users for the admin list
+type UserFilter struct {
+	Search  string
+	Status  string // active (default), inactive or all
+	Page    int
+	PerPage int
+}
+
+// CreateUserRequest is the input for an admin creating an account
+type CreateUserRequest struct {
+	RegisterRequest
+	Role     string `json:"role" form:"role"`
+	Verified bool   `json:"verified" form:"verified"`
+}
+
+// UpdateUserRequest is the input for an admin editing an account
+type UpdateUserRequest struct {
+	Username  string `json:"username" form:"username"`
+	Email     string `json:"email" form:"email"`
+	FirstName string `json:"first_name" form:"first_name"`
+	LastName  string `json:"last_name" form:"last_name"`
+}
+
+// Validate normalises the request and reports every invalid field
+func (r *UpdateUserRequest) Validate() error {
+	r.Username = NormalizeUsername(r.Username)
+	r.Email = strings.TrimSpace(r.Email)
+	r.FirstName = strings.TrimSpace(r.FirstName)
+	r.LastName = strings.TrimSpace(r.LastName)
+
+	errs := ValidationErrors{}
+	if !usernamePattern.MatchString(r.Username) {
+		errs["username"] = "Username must be 3-50 characters of letters, numbers, '.', '_' or '-'"
+	}
+	if addr, err := mail.ParseAddress(r.Email); err != nil || addr.Address != r.Email || len(r.Email) > 255 {
+		errs["email"] = "A valid email address is required"
+	}
+	if len(r.FirstName) > 100 {
+		errs["first_name"] = "First name must be at most 100 characters"
+	}
+	if len(r.LastName) > 100 {
+		errs["last_name"] = "Last name must be at most 100 characters"
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ListUsers returns one page of users matching filter and the total number of matches
+func (a *AuthService) ListUsers(ctx context.Context, filter UserFilter) ([]database.ListUsersRow, int64, error) {
+	var isActive pgtype.Bool
+	switch filter.Status {
+	case "", "active":
+		isActive = database.BoolToPgBool(true)
+	case "inactive":
+		isActive = database.BoolToPgBool(false)
+	case "all":
+	default:
+		return nil, 0, ValidationErrors{"status": "Status must be active, inactive or all"}
+	}
+
+	var search pgtype.Text
+	if s := strings.TrimSpace(filter.Search); s != "" {
+		search = database.StringToPgText(likeEscaper.Replace(s))
+	}
+
+	total, err := a.db.CountUsers(ctx, database.CountUsersParams{
+		Search:   search,
+		IsActive: isActive,
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count users: %w", err)
+	}
+
+	users, err := a.db.ListUsers(ctx, database.ListUsersParams{
+		Search:     search,
+		IsActive:   isActive,
+		PageLimit:  int32(filter.PerPage),
+		PageOffset: int32((filter.Page - 1) * filter.PerPage),
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list users: %w", err)
+	}
+	return users, total, nil
+}
+
+// GetUser loads a user whether or not the account is active
+func (a *AuthService) GetUser(ctx context.Context, userID int32) (*database.User, error) {
+	user, err := a.db.GetAnyUserByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	return &user, nil
+}
+
+// CreateUser creates an account on someone's behalf. Unless it is created verified,
+// the owner is sent the usual verification email. Only an actor who can manage roles may
+// give the account anything but DefaultRole.
+func (a *AuthService) CreateUser(ctx context.Context, actor *Access, req CreateUserRequest) (*database.User, error) {
+	if err := req.Validate(a.passwords); err != nil {
+		return nil, err
+	}
+	role := strings.TrimSpace(req.Role)
+	if role == "" {
+		role = DefaultRole
+	}
+	if role != DefaultRole && !actor.Can(PermRolesManage) {
+		return nil, ErrRoleForbidden
+	}
+	if _, err := a.db.GetRoleByName(ctx, role); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ValidationErrors{"role": "Unknown role"}
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	hashedPassword, err := a.HashPassword(req.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := a.db.CreateUser(ctx, database.CreateUserParams{
+		Username:     req.Username,
+		Email:        req.Email,
+		PasswordHash: hashedPassword,
+		FirstName:    database.StringToPgText(req.FirstName),
+		LastName:     database.StringToPgText(req.LastName),
+	})
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, ErrUserExists
+		}
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	if err := a.AssignRole(ctx, created.ID, role); err != nil {
+		return nil, err
+	}
+
+	if req.Verified {
+		if err := a.db.VerifyUser(ctx, created.ID); err != nil {
+			return nil, fmt.Errorf("failed to verify user: %w", err)
+		}
+	} else if err := a.SendVerificationEmail(ctx, created.ID, created.Username, created.Email); err != nil {
+		slog.Error("failed to send verification email", slog.Any("user_id", created.ID), slog.Any("error", err))
+	}
+
+	return a.GetUser(ctx, created.ID)
+}
+
+// checkOutranks returns ErrOutranked unless actor holds every permission the user has, so
+// taking over or locking out the account cannot be a way into more access
+func (a *AuthService) checkOutranks(ctx context.Context, actor *Access, userID int32) error {
+	access, err := a.UserAccess(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !actor.Covers(access) {
+		return ErrOutranked
+	}
+	return nil
+}
+
+// UpdateUser edits an active user's profile. Changing the email address is a way into the
+// account, so the actor must hold every permission the user has.
+func (a *AuthService) UpdateUser(ctx context.Context, actor *Access, userID int32, req UpdateUserRequest) (*database.User, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	user, err := a.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !database.PgBoolToBool(user.IsActive) {
+		return nil, ErrUserInactive
+	}
+	if err := a.checkOutranks(ctx, actor, userID); err != nil {
+		return nil, err
+	}
+
+	if _, err := a.db.UpdateUser(ctx, database.UpdateUserParams{
+		ID:        userID,
+		Username:  req.Username,
+		Email:     req.Email,
+		FirstName: database.StringToPgText(req.FirstName),
+		LastName:  database.StringToPgText(req.LastName),
+	}); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, ErrUserExists
+		}
+		return nil, fmt.Errorf("failed to update user: %w", err)
+	}
+	a.forgetUser(userID)
+
+	return a.GetUser(ctx, userID)
+}
+
+// DeactivateUser disables an account and signs it out everywhere. actorID and actor are the
+// admin doing so, who must hold every permission the user has.
+func (a *AuthService) DeactivateUser(ctx context.Context, actorID int32, actor *Access, userID int32) error {
+	if actorID == userID {
+		return ErrSelfDeactivate
+	}
+	if _, err := a.GetUser(ctx, userID); err != nil {
+		return err
+	}
+	if err := a.checkOutranks(ctx, actor, userID); err != nil {
+		return err
+	}
+
+	if err := a.db.DeactivateUser(ctx, userID); err != nil {
+		return fmt.Errorf("failed to deactivate user: %w", err)
+	}
+	a.forgetUser(userID)
+	return a.RevokeAllSessions(ctx, userID)
+}
+
+// ReactivateUser re-enables a deactivated account
+func (a *AuthService) ReactivateUser(ctx context.Context, userID int32) error {
+	if _, err := a.GetUser(ctx, userID); err != nil {
+		return err
+	}
+
+	if err := a.db.ReactivateUser(ctx, userID); err != nil {
+		return fmt.Errorf("failed to reactivate user: %w", err)
+	}
+	a.forgetUser(userID)
+	return nil
+}
+
+// ForceVerifyUser marks a user's email address as confirmed
+func (a *AuthService) ForceVerifyUser(ctx context.Context, userID int32) error {
+	if _, err := a.GetUser(ctx, userID); err != nil {
+		return err
+	}
+
+	if err := a.db.VerifyUser(ctx, userID); err != nil {
+		return fmt.Errorf("failed to verify user: %w", err)
+	}
+	a.forgetUser(userID)
+	return nil
+}
+
+// AdminResetPassword sets a new password for the user and signs them out everywhere.
+// With an empty password the user is emailed a reset link instead. The actor must hold every
+// permission the user has, or resetting it would be a way into more access.
+func (a *AuthService) AdminResetPassword(ctx context.Context, actor *Access, userID int32, password string) error {
+	user, err := a.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !database.PgBoolToBool(user.IsActive) {
+		return ErrUserInactive
+	}
+
+	if err := a.checkOutranks(ctx, actor, userID); err != nil {
+		return err
+	}
+
+	if password == "" {
+		return a.RequestPasswordReset(ctx, user.Email)
+	}
+
+	if msg := a.passwords.Check(password, user.Username, user.Email); msg != "" {
+		return ValidationErrors{"password": msg}
+	}
+	hashedPassword, err := a.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := a.db.UpdateUserPassword(ctx, database.UpdateUserPasswordParams{
+		ID:           userID,
+		PasswordHash: hashedPassword,
+	}); err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	a.forgetUser(userID)
+	a.recordSecurityEvent(ctx, EventPasswordChanged, slog.Any("user_id", userID), slog.String("method", "admin"))
+	return a.RevokeAllSessions(ctx, userID)
+}
+
+// userDetail builds the response for a single user, including their roles
+func (h *AuthHandlers) userDetail(ctx context.Context, user *database.User) (AdminUserResponse, error) {
+	resp := AdminUserResponse{UserResponse: NewUserResponse(*user)}
+	roles, err := h.authService.db.ListUserRoles(ctx, user.ID)
+	if err != nil {
+		return resp, err
+	}
+	resp.Roles = roles
+	return resp, nil
+}
+
+// User administration page (GET)
+func (h *AuthHandlers) ShowAdminUsers(c echo.Context) error {
+	access, err := currentAccess(c)
+	if err != nil {
+		slog.Error("failed to load user access", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load users",
+		})
+	}
+
+	return c.HTML(http.StatusOK, csrfScript(c)+`
+		<h1>Users</h1>
+		<form id="search">
+			<input type="search" name="q" placeholder="Search username or email">
+			<select name="status">
+				<option value="active">Active</option>
+				<option value="inactive">Deactivated</option>
+				<option value="all">All</option>
+			</select>
+			<button type="submit">Search</button>
+		</form>
+		<table>
+			<thead><tr><th>Username</th><th>Email</th><th>Name</th><th>Status</th><th>Roles</th><th></th></tr></thead>
+			<tbody id="users"></tbody>
+		</table>
+		<p><button id="prev">Previous</button> <span id="page"></span> <button id="next">Next</button></p>
+		<h2>New user</h2>
+		<form id="create">
+			<input type="text" name="username" placeholder="Username" required>
+			<input type="email" name="email" placeholder="Email" required>
+			<input type="text" name="first_name" placeholder="First name">
+			<input type="text" name="last_name" placeholder="Last name">
+			<input type="password" name="password" placeholder="Password" required>
+			<input type="text" name="role" placeholder="Role (default viewer)">
+			<label><input type="checkbox" name="verified"> Email already verified</label>
+			<button type="submit">Create user</button>
+		</form>
+		<p id="status"></p>
+		<script>
+		const canImpersonate = `+strconv.FormatBool(access.Can(PermUsersImpersonate))+`;
+		const status = document.getElementById('status');
+		let page = 1;
+		async function api(method, path, body) {
+			const res = await fetch('/api/admin/users' + path, {
+				method,
+				headers: {'Accept': 'application/json', 'Content-Type': 'application/json'},
+				body: body === undefined ? undefined : JSON.stringify(body),
+			});
+			const data = res.status === 204 ? {} : await res.json();
+			if (!res.ok) throw new Error(data.error + (data.fields ? ': ' + Object.values(data.fields).join(', ') : ''));
+			return data;
+		}
+		function action(label, fn) {
+			const button = document.createElement('button');
+			button.textContent = label;
+			button.onclick = async () => {
+				try {
+					await fn();
+					load();
+				} catch (err) {
+					status.textContent = err.message;
+				}
+			};
+			return button;
+		}
+		async function load() {
+			const search = new FormData(document.getElementById('search'));
+			const query = new URLSearchParams({q: search.get('q'), status: search.get('status'), page});
+			const data = await api('GET', '?' + query);
+			const body = document.getElementById('users');
+			body.replaceChildren();
+			for (const user of data.users) {
+				const row = document.createElement('tr');
+				const name = [user.first_name, user.last_name].filter(Boolean).join(' ');
+				const state = (user.active ? 'active' : 'deactivated') + (user.verified ? '' : ', unverified');
+				for (const text of [user.username, user.email, name, state, (user.roles || []).join(', ')]) {
+					const cell = document.createElement('td');
+					cell.textContent = text;
+					row.append(cell);
+				}
+				const actions = document.createElement('td');
+				actions.append(action('Edit', async () => {
+					const email = prompt('Email', user.email);
+					if (!email) return;
+					await api('PATCH', '/' + user.id, {username: user.username, email, first_name: user.first_name || '', last_name: user.last_name || ''});
+				}));
+				if (user.active) {
+					actions.append(action('Deactivate', () => confirm('Deactivate ' + user.username + '?') && api('POST', '/' + user.id + '/deactivate')));
+					actions.append(action('Send password reset', () => api('POST', '/' + user.id + '/password', {})));
+					actions.append(action('Unlock sign-in', () => api('POST', '/' + user.id + '/unlock')));
+					actions.append(action('Sign out everywhere', () => api('DELETE', '/' + user.id + '/sessions')));
+					if (canImpersonate) {
+						actions.append(action('View as', async () => {
+							const data = await api('POST', '/' + user.id + '/impersonate');
+							location.href = data.redirect;
+						}));
+					}
+				} else {
+					actions.append(action('Reactivate', () => api('POST', '/' + user.id + '/reactivate')));
+				}
+				if (!user.verified) {
+					actions.append(action('Mark verified', () => api('POST', '/' + user.id + '/verify')));
+				}
+				row.append(actions);
+				body.append(row);
+			}
+			const pages = Math.max(1, Math.ceil(data.total / data.per_page));
+			document.getElementById('page').textContent = 'Page ' + data.page + ' of ' + pages + ' (' + data.total + ' users)';
+			document.getElementById('prev').disabled = data.page <= 1;
+			document.getElementById('next').disabled = data.page >= pages;
+		}
+		document.getElementById('search').addEventListener('submit', (e) => { e.preventDefault(); page = 1; load(); });
+		document.getElementById('prev').addEventListener('click', () => { page--; load(); });
+		document.getElementById('next').addEventListener('click', () => { page++; load(); });
+		document.getElementById('create').addEventListener('submit', async (e) => {
+			e.preventDefault();
+			const form = Object.fromEntries(new FormData(e.target));
+			form.verified = form.verified === 'on';
+			try {
+				await api('POST', '', form);
+				e.target.reset();
+				status.textContent = 'User created.';
+				load();
+			} catch (err) {
+				status.textContent = err.message;
+			}
+		});
+		load();
+		</script>
+	`)
+}
+
+// List, search and paginate users (GET)
+func (h *AuthHandlers) ListUsers(c echo.Context) error {
+	filter := UserFilter{
+		Search:  c.QueryParam("q"),
+		Status:  c.QueryParam("status"),
+		Page:    1,
+		PerPage: defaultUsersPerPage,
+	}
+	if page, err := strconv.Atoi(c.QueryParam("page")); err == nil && page > 0 {
+		filter.Page = page
+	}
+	if perPage, err := strconv.Atoi(c.QueryParam("per_page")); err == nil && perPage > 0 {
+		filter.PerPage = min(perPage, maxUsersPerPage)
+	}
+
+	ctx := c.Request().Context()
+	rows, total, err := h.authService.ListUsers(ctx, filter)
+	if err != nil {
+		return adminUserError(c, err)
+	}
+
+	users := make([]AdminUserResponse, 0, len(rows))
+	for _, row := range rows {
+		user := AdminUserResponse{UserResponse: newListedUserResponse(row)}
+		if user.Roles, err = h.authService.db.ListUserRoles(ctx, row.ID); err != nil {
+			return adminUserError(c, err)
+		}
+		users = append(users, user)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"users":    users,
+		"total":    total,
+		"page":     filter.Page,
+		"per_page": filter.PerPage,
+	})
+}
+
+// Show one user (GET)
+func (h *AuthHandlers) GetUser(c echo.Context) error {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	ctx := c.Request().Context()
+	user, err := h.authService.GetUser(ctx, userID)
+	if err != nil {
+		return adminUserError(c, err)
+	}
+	resp, err := h.userDetail(ctx, user)
+	if err != nil {
+		return adminUserError(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// Create a user (POST)
+func (h *AuthHandlers) CreateUser(c echo.Context) error {
+	var req CreateUserRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user request",
+		})
+	}
+
+	actor, err := currentAccess(c)
+	if err != nil {
+		return adminUserError(c, err)
+	}
+
+	ctx := c.Request().Context()
+	user, err := h.authService.CreateUser(ctx, actor, req)
+	if err != nil {
+		return adminUserError(c, err)
+	}
+	resp, err := h.userDetail(ctx, user)
+	if err != nil {
+		return adminUserError(c, err)
+	}
+	return c.JSON(http.StatusCreated, resp)
+}
+
+// Edit a user's profile (PATCH)
+func (h *AuthHandlers) UpdateUser(c echo.Context) error {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	var req UpdateUserRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user request",
+		})
+	}
+
+	actor, err := currentAccess(c)
+	if err != nil {
+		return adminUserError(c, err)
+	}
+
+	ctx := c.Request().Context()
+	user, err := h.authService.UpdateUser(ctx, actor, userID, req)
+	if err != nil {
+		return adminUserError(c, err)
+	}
+	resp, err := h.userDetail(ctx, user)
+	if err != nil {
+		return adminUserError(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// Deactivate a user (POST)
+func (h *AuthHandlers) DeactivateUser(c echo.Context) error {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	actor, err := currentAccess(c)
+	if err != nil {
+		return adminUserError(c, err)
+	}
+
+	if err := h.authService.DeactivateUser(c.Request().Context(), c.Get("user_id").(int32), actor, userID); err != nil {
+		return adminUserError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Reactivate a user (POST)
+func (h *AuthHandlers) ReactivateUser(c echo.Context) error {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	if err := h.authService.ReactivateUser(c.Request().Context(), userID); err != nil {
+		return adminUserError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Mark a user's email as verified (POST)
+func (h *AuthHandlers) ForceVerifyUser(c echo.Context) error {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	if err := h.authService.ForceVerifyUser(c.Request().Context(), userID); err != nil {
+		return adminUserError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Set a user's password, or email them a reset link when no password is given (POST)
+func (h *AuthHandlers) AdminResetPassword(c echo.Context) error {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	var req struct {
+		Password string `json:"password" form:"password"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid password request",
+		})
+	}
+
+	actor, err := currentAccess(c)
+	if err != nil {
+		return adminUserError(c, err)
+	}
+
+	if err := h.authService.AdminResetPassword(c.Request().Context(), actor, userID, req.Password); err != nil {
+		return adminUserError(c, err)
+	}
+	if req.Password == "" {
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": "Password reset link sent",
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Password updated",
+	})
+}
+
+// List accounts renamed when usernames and emails became case-insensitive (GET)
+func (h *AuthHandlers) ListIdentityConflicts(c echo.Context) error {
+	rows, err := h.authService.db.ListIdentityConflicts(c.Request().Context())
+	if err != nil {
+		slog.Error("failed to list identity conflicts", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list identity conflicts",
+		})
+	}
+
+	conflicts := make([]IdentityConflictResponse, 0, len(rows))
+	for _, row := range rows {
+		conflicts = append(conflicts, NewIdentityConflictResponse(row))
+	}
+	return c.JSON(http.StatusOK, conflicts)
+}
+
+func userIDParam(c echo.Context) (int32, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	return int32(id), err == nil
+}
+
+func adminUserError(c echo.Context, err error) error {
+	var validationErrs ValidationErrors
+	switch {
+	case errors.As(err, &validationErrs):
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":  "Invalid user details",
+			"fields": validationErrs,
+		})
+	case errors.Is(err, ErrUserNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": err.Error(),
+		})
+	case errors.Is(err, ErrRoleForbidden), errors.Is(err, ErrOutranked):
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": err.Error(),
+		})
+	case errors.Is(err, ErrUserExists), errors.Is(err, ErrUserInactive), errors.Is(err, ErrSelfDeactivate):
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": err.Error(),
+		})
+	default:
+		slog.Error("user administration failed", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to update user",
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// An admin must not be able to take over or lock out an account that holds access they lack
+func TestAdminActionsRequireCoveringAccess(t *testing.T) {
+	manager := &Access{Roles: []string{"manager"}, Permissions: map[string]bool{PermUsersRead: true, PermUsersManage: true}}
+	admin := &Access{Roles: []string{RoleAdmin}}
+
+	actions := []struct {
+		name string
+		do   func(a *AuthService, actor *Access, actorID, userID int32) error
+	}{
+		{"update", func(a *AuthService, actor *Access, actorID, userID int32) error {
+			_, err := a.UpdateUser(context.Background(), actor, userID, UpdateUserRequest{
+				Username: "taken-over",
+				Email:    "attacker@example.test",
+			})
+			return err
+		}},
+		{"deactivate", func(a *AuthService, actor *Access, actorID, userID int32) error {
+			return a.DeactivateUser(context.Background(), actorID, actor, userID)
+		}},
+		{"reset password", func(a *AuthService, actor *Access, actorID, userID int32) error {
+			return a.AdminResetPassword(context.Background(), actor, userID, "a brand new passphrase")
+		}},
+	}
+	targets := []struct {
+		name    string
+		actor   *Access
+		grant   func(db *fakeDB, userID int32)
+		allowed bool
+	}{
+		{"manager on admin", manager, func(db *fakeDB, userID int32) { db.grant(userID, RoleAdmin) }, false},
+		{"manager on role manager", manager, func(db *fakeDB, userID int32) {
+			db.grant(userID, "role-manager", PermRolesManage)
+		}, false},
+		{"manager on impersonator", manager, func(db *fakeDB, userID int32) {
+			db.grant(userID, "support", PermUsersRead, PermUsersImpersonate)
+		}, false},
+		{"manager on peer", manager, func(db *fakeDB, userID int32) {
+			db.grant(userID, "manager", PermUsersRead, PermUsersManage)
+		}, true},
+		{"manager on plain user", manager, func(db *fakeDB, userID int32) { db.grant(userID, DefaultRole) }, true},
+		{"admin on admin", admin, func(db *fakeDB, userID int32) { db.grant(userID, RoleAdmin) }, true},
+	}
+
+	for _, action := range actions {
+		for _, target := range targets {
+			t.Run(action.name+"/"+target.name, func(t *testing.T) {
+				a, db := newTestAuthService(t)
+				actor := db.addUser(t, a, "actor", "actor password")
+				user := db.addUser(t, a, "target", "target password")
+				target.grant(db, user.ID)
+				if _, err := a.CreateSession(context.Background(), user.ID, "192.0.2.1", "test", false); err != nil {
+					t.Fatal(err)
+				}
+
+				err := action.do(a, target.actor, actor.ID, user.ID)
+				if target.allowed {
+					if err != nil {
+						t.Fatalf("err = %v, want success", err)
+					}
+					return
+				}
+				if !errors.Is(err, ErrOutranked) {
+					t.Fatalf("err = %v, want ErrOutranked", err)
+				}
+				if db.user(user.ID) != *user {
+					t.Errorf("refused %s still changed the account", action.name)
+				}
+				if len(db.sessionIDs(user.ID)) != 1 {
+					t.Errorf("refused %s still signed the user out", action.name)
+				}
+			})
+		}
+	}
+}
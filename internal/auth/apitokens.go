@@ -0,0 +1,384 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/labstack/echo/v4"
+)
+
+// API token errors
+var (
+	ErrInvalidAPIToken = errors.New("invalid or expired API token")
+	ErrSessionRequired = errors.New("this endpoint requires signing in with a browser session")
+)
+
+const (
+	// Every API token starts with this, so leaked tokens are easy to recognise
+	apiTokenPrefix = "stf_"
+	// Characters of the token kept in clear to identify it in listings
+	apiTokenDisplayLength = 12
+	// Longest lifetime a token may be created with
+	maxAPITokenDays = 365
+	// last_used_at is only written this often per token
+	apiTokenTouchInterval = time.Minute
+)
+
+// Context keys set when a request authenticates with an API token
+const (
+	apiTokenIDContextKey     = "api_token_id"
+	apiTokenScopesContextKey = "api_token_scopes"
+)
+
+// CreateAPITokenRequest is the input for creating a personal access token
+type CreateAPITokenRequest struct {
+	Name          string   `json:"name" form:"name"`
+	Scopes        []string `json:"scopes" form:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days" form:"expires_in_days"` // 0 means the token never expires
+}
+
+// CreateAPIToken issues a token for the user limited to scopes, each of which must be a
+// permission the user holds. The plaintext token is only ever returned here.
+func (a *AuthService) CreateAPIToken(ctx context.Context, userID int32, req CreateAPITokenRequest) (string, *database.ApiToken, error) {
+	req.Name = strings.TrimSpace(req.Name)
+
+	errs := ValidationErrors{}
+	if req.Name == "" || len(req.Name) > 100 {
+		errs["name"] = "Name must be 1-100 characters"
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxAPITokenDays {
+		errs["expires_in_days"] = fmt.Sprintf("Expiry must be between 0 (never) and %d days", maxAPITokenDays)
+	}
+
+	access, err := a.UserAccess(ctx, userID)
+	if err != nil {
+		return "", nil, err
+	}
+	known, err := a.db.ListPermissions(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("database error: %w", err)
+	}
+	scopes := make([]string, 0, len(req.Scopes))
+	for _, scope := range req.Scopes {
+		if !permissionExists(known, scope) || !access.Can(scope) {
+			errs["scopes"] = fmt.Sprintf("You cannot grant the %q scope", scope)
+			break
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 && errs["scopes"] == "" {
+		errs["scopes"] = "Choose at least one scope"
+	}
+
+	if len(errs) > 0 {
+		return "", nil, errs
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+	plaintext := apiTokenPrefix + secret
+
+	var expiresAt pgtype.Timestamptz
+	if req.ExpiresInDays > 0 {
+		expiresAt = database.TimeToPgTimestamptz(time.Now().AddDate(0, 0, req.ExpiresInDays))
+	}
+
+	token, err := a.db.CreateAPIToken(ctx, database.CreateAPITokenParams{
+		UserID:    userID,
+		Name:      req.Name,
+		Prefix:    plaintext[:apiTokenDisplayLength],
+		TokenHash: hashToken(plaintext),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to store API token: %w", err)
+	}
+	a.recordSecurityEvent(ctx, EventAPITokenCreated,
+		slog.Any("user_id", userID),
+		slog.Any("token_id", token.ID),
+		slog.String("name", token.Name),
+		slog.String("prefix", token.Prefix),
+		slog.Any("scopes", token.Scopes),
+	)
+	return plaintext, &token, nil
+}
+
+// AuthenticateAPIToken returns the token row for a presented bearer token
+func (a *AuthService) AuthenticateAPIToken(ctx context.Context, plaintext string) (*database.GetAPITokenByHashRow, error) {
+	if !strings.HasPrefix(plaintext, apiTokenPrefix) {
+		return nil, ErrInvalidAPIToken
+	}
+
+	token, err := a.db.GetAPITokenByHash(ctx, hashToken(plaintext))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrInvalidAPIToken
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	if token.ExpiresAt.Valid && time.Now().After(token.ExpiresAt.Time) {
+		return nil, ErrInvalidAPIToken
+	}
+
+	if !token.LastUsedAt.Valid || time.Since(token.LastUsedAt.Time) > apiTokenTouchInterval {
+		if err := a.db.TouchAPIToken(ctx, token.ID); err != nil {
+			slog.Error("failed to record API token use", slog.Any("token_id", token.ID), slog.Any("error", err))
+		}
+	}
+	return &token, nil
+}
+
+// RevokeAPIToken deletes one of the user's tokens
+func (a *AuthService) RevokeAPIToken(ctx context.Context, userID, tokenID int32) error {
+	n, err := a.db.DeleteAPIToken(ctx, database.DeleteAPITokenParams{
+		ID:     tokenID,
+		UserID: userID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete API token: %w", err)
+	}
+	if n == 0 {
+		return ErrInvalidAPIToken
+	}
+	a.recordSecurityEvent(ctx, EventAPITokenRevoked, slog.Any("user_id", userID), slog.Any("token_id", tokenID))
+	return nil
+}
+
+func permissionExists(permissions []database.Permission, name string) bool {
+	for _, p := range permissions {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// APIAuthMiddleware authenticates with an "Authorization: Bearer" API token when one is sent,
+// and falls back to the session cookie otherwise. Either way it sets the same context keys.
+func APIAuthMiddleware(authService *AuthService) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		sessionAuth := AuthMiddleware(authService)(next)
+		return func(c echo.Context) error {
+			header := c.Request().Header.Get(echo.HeaderAuthorization)
+			if header == "" {
+				return sessionAuth(c)
+			}
+
+			scheme, plaintext, ok := strings.Cut(header, " ")
+			if !ok || !strings.EqualFold(scheme, "Bearer") {
+				return bearerUnauthorized(c, "Unsupported authorization scheme")
+			}
+
+			token, err := authService.AuthenticateAPIToken(c.Request().Context(), strings.TrimSpace(plaintext))
+			if err != nil {
+				if !errors.Is(err, ErrInvalidAPIToken) {
+					slog.Error("API token authentication failed", slog.Any("error", err))
+					return c.JSON(http.StatusInternalServerError, map[string]string{
+						"error": "Authentication failed",
+					})
+				}
+				return bearerUnauthorized(c, ErrInvalidAPIToken.Error())
+			}
+
+			c.Set(authServiceContextKey, authService)
+			c.Set(apiTokenIDContextKey, token.ID)
+			c.Set(apiTokenScopesContextKey, token.Scopes)
+			c.Set(IsVerifiedKey, database.PgBoolToBool(token.IsVerified))
+			c.Set("user_id", token.UserID)
+			c.Set("username", token.Username)
+			setEventActor(c, token.UserID)
+
+			return next(c)
+		}
+	}
+}
+
+// RequireSessionMiddleware rejects requests authenticated with an API token,
+// so a leaked token cannot be used to mint more tokens or change sign-in methods
+func RequireSessionMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Get(apiTokenIDContextKey) != nil {
+				return c.JSON(http.StatusForbidden, map[string]string{
+					"error": ErrSessionRequired.Error(),
+				})
+			}
+			return next(c)
+		}
+	}
+}
+
+func bearerUnauthorized(c echo.Context, message string) error {
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+	return c.JSON(http.StatusUnauthorized, map[string]string{
+		"error": message,
+	})
+}
+
+// API token settings page (GET)
+func (h *AuthHandlers) ShowAPITokens(c echo.Context) error {
+	access, err := currentAccess(c)
+	if err != nil {
+		slog.Error("failed to load user access", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load API tokens",
+		})
+	}
+	permissions, err := h.authService.db.ListPermissions(c.Request().Context())
+	if err != nil {
+		slog.Error("failed to list permissions", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load API tokens",
+		})
+	}
+
+	var scopes strings.Builder
+	for _, p := range permissions {
+		if access.Can(p.Name) {
+			fmt.Fprintf(&scopes, `<label><input type="checkbox" name="scopes" value="%s"> %s</label>`,
+				html.EscapeString(p.Name), html.EscapeString(p.Name))
+		}
+	}
+
+	return c.HTML(http.StatusOK, csrfScript(c)+fmt.Sprintf(`
+		<h1>API tokens</h1>
+		<ul id="tokens"></ul>
+		<form id="create">
+			<input type="text" name="name" placeholder="Name, e.g. Field tablet" required>
+			%s
+			<select name="expires_in_days">
+				<option value="30">Expires in 30 days</option>
+				<option value="90" selected>Expires in 90 days</option>
+				<option value="365">Expires in a year</option>
+				<option value="0">Never expires</option>
+			</select>
+			<button type="submit">Create token</button>
+		</form>
+		<p id="token-status"></p>
+		<script>
+		const status = document.getElementById('token-status');
+		async function load() {
+			const list = document.getElementById('tokens');
+			list.replaceChildren();
+			const tokens = await (await fetch('/api/tokens', {headers: {'Accept': 'application/json'}})).json();
+			for (const token of tokens) {
+				const li = document.createElement('li');
+				li.textContent = token.name + ' (' + token.prefix + '…, ' + token.scopes.join(', ') + ')' +
+					(token.expires_at ? ' expires ' + token.expires_at : ' never expires') +
+					(token.last_used_at ? ', last used ' + token.last_used_at : ', never used') + ' ';
+				const revoke = document.createElement('button');
+				revoke.textContent = 'Revoke';
+				revoke.onclick = async () => {
+					if (!confirm('Revoke ' + token.name + '?')) return;
+					await fetch('/api/tokens/' + token.id, {method: 'DELETE'});
+					load();
+				};
+				li.append(revoke);
+				list.append(li);
+			}
+		}
+		document.getElementById('create').addEventListener('submit', async (e) => {
+			e.preventDefault();
+			const form = new FormData(e.target);
+			const res = await fetch('/api/tokens', {
+				method: 'POST',
+				headers: {'Content-Type': 'application/json'},
+				body: JSON.stringify({name: form.get('name'), scopes: form.getAll('scopes'), expires_in_days: Number(form.get('expires_in_days'))}),
+			});
+			const data = await res.json();
+			if (!res.ok) {
+				status.textContent = data.error + (data.fields ? ': ' + Object.values(data.fields).join(', ') : '');
+				return;
+			}
+			e.target.reset();
+			status.textContent = 'Copy your new token now, it will not be shown again: ' + data.token;
+			load();
+		});
+		load();
+		</script>
+	`, scopes.String()))
+}
+
+// List the logged in user's API tokens (GET)
+func (h *AuthHandlers) ListAPITokens(c echo.Context) error {
+	rows, err := h.authService.db.ListAPITokensByUser(c.Request().Context(), c.Get("user_id").(int32))
+	if err != nil {
+		slog.Error("failed to list API tokens", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list API tokens",
+		})
+	}
+
+	tokens := make([]APITokenResponse, 0, len(rows))
+	for _, row := range rows {
+		tokens = append(tokens, NewAPITokenResponse(row))
+	}
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// Create an API token (POST)
+func (h *AuthHandlers) CreateAPIToken(c echo.Context) error {
+	var req CreateAPITokenRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid token request",
+		})
+	}
+
+	plaintext, token, err := h.authService.CreateAPIToken(c.Request().Context(), c.Get("user_id").(int32), req)
+	if err != nil {
+		var validationErrs ValidationErrors
+		if errors.As(err, &validationErrs) {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"error":  "Invalid token details",
+				"fields": validationErrs,
+			})
+		}
+		slog.Error("failed to create API token", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to create API token",
+		})
+	}
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"token":   plaintext,
+		"details": NewAPITokenResponse(*token),
+	})
+}
+
+// Revoke an API token (DELETE)
+func (h *AuthHandlers) RevokeAPIToken(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid token ID",
+		})
+	}
+
+	if err := h.authService.RevokeAPIToken(c.Request().Context(), c.Get("user_id").(int32), int32(id)); err != nil {
+		if errors.Is(err, ErrInvalidAPIToken) {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Token not found",
+			})
+		}
+		slog.Error("failed to revoke API token", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to revoke API token",
+		})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -2,17 +2,19 @@ package auth
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/dukerupert/south-texas-farmer/internal/mailer"
 	"github.com/gorilla/sessions"
+	"github.com/jackc/pgx/v5"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Common errors for authentication
@@ -21,100 +23,299 @@ var (
 	ErrUserNotFound       = errors.New("user not found")
 )
 
+// Config holds the settings the auth service needs beyond the database
+type Config struct {
+	BaseURL   string          // public URL used to build links in outbound email
+	SecretKey []byte          // key for signing verification tokens
+	Passwords PasswordPolicy  // rules for new passwords; DefaultPasswordPolicy when unset
+	Hasher    *PasswordHasher // hashes new passwords; DefaultHasherConfig when unset
+	Sessions  SessionConfig   // login lifetimes and cookie scope; DefaultSessionConfig when unset
+}
+
 // AuthService handles authentication logic
 type AuthService struct {
-	db *database.Queries
+	db        *database.Queries
+	mailer    mailer.Mailer
+	tokens    *TokenSigner
+	baseURL   string
+	passwords PasswordPolicy
+	hasher    *PasswordHasher
+	users     *userCache
+	sessions  SessionConfig
+	// Compared against when the username is unknown, so those logins take as long as real ones
+	dummyHash string
 }
 
-func NewAuthService(db *database.Queries) *AuthService {
-	return &AuthService{db: db}
+func NewAuthService(db *database.Queries, mail mailer.Mailer, cfg Config) *AuthService {
+	if cfg.Passwords == (PasswordPolicy{}) {
+		cfg.Passwords = DefaultPasswordPolicy()
+	}
+	if cfg.Sessions == (SessionConfig{}) {
+		cfg.Sessions = DefaultSessionConfig()
+	}
+	if cfg.Hasher == nil {
+		// The defaults are always valid
+		cfg.Hasher, _ = NewPasswordHasher(DefaultHasherConfig())
+	}
+
+	dummyHash, err := cfg.Hasher.Hash("not-a-real-password")
+	if err != nil {
+		panic(err)
+	}
+
+	return &AuthService{
+		db:        db,
+		mailer:    mail,
+		tokens:    NewTokenSigner(cfg.SecretKey),
+		baseURL:   strings.TrimRight(cfg.BaseURL, "/"),
+		passwords: cfg.Passwords,
+		hasher:    cfg.Hasher,
+		users:     newUserCache(),
+		sessions:  cfg.Sessions,
+		dummyHash: dummyHash,
+	}
 }
 
-func (a *AuthService) ValidateCredentials(ctx context.Context, username, password string) (*database.User, error) {
+// ValidateCredentials checks password for the account whose username or email is identifier,
+// ignoring case
+func (a *AuthService) ValidateCredentials(ctx context.Context, identifier, password string) (*database.User, error) {
 	// Get user from database
-	user, err := a.db.GetUserByUsername(ctx, username)
+	user, err := a.findLoginUser(ctx, identifier)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			// Don't reveal whether user exists or not
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Don't reveal whether user exists or not, in the response or its timing
+			_, _, _ = a.hasher.Verify(a.dummyHash, password)
 			return nil, ErrInvalidCredentials
 		}
 		return nil, fmt.Errorf("database error: %w", err)
 	}
 
 	// Compare the provided password with stored hash
-	if err := a.ComparePassword(user.PasswordHash, password); err != nil {
-		return nil, err // This will be ErrInvalidCredentials if password doesn't match
+	ok, rehash, err := a.hasher.Verify(user.PasswordHash, password)
+	if err != nil {
+		return nil, fmt.Errorf("password comparison failed: %w", err)
+	}
+	if !ok {
+		// Return a generic error to avoid leaking information
+		return nil, ErrInvalidCredentials
+	}
+
+	// Upgrade hashes made with an older algorithm or cost while the password is at hand
+	if rehash {
+		a.rehashPassword(ctx, user.ID, password)
 	}
 
 	return &user, nil
 }
 
-// HashPassword creates a bcrypt hash from a plain text password
-func HashPassword(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+// findLoginUser looks identifier up as an email address when it looks like one, and as a username otherwise
+func (a *AuthService) findLoginUser(ctx context.Context, identifier string) (database.User, error) {
+	identifier = NormalizeUsername(identifier)
+	if strings.Contains(identifier, "@") {
+		user, err := a.db.GetUserByEmail(ctx, identifier)
+		// Accounts created before usernames were restricted may contain "@"
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return user, err
+		}
+	}
+	return a.db.GetUserByUsername(ctx, identifier)
+}
+
+// rehashPassword stores a fresh hash of password made with the current settings. Failure is
+// only logged, since the login itself succeeded.
+func (a *AuthService) rehashPassword(ctx context.Context, userID int32, password string) {
+	hashedPassword, err := a.hasher.Hash(password)
 	if err != nil {
-		return "", fmt.Errorf("failed to hash password: %w", err)
+		slog.Error("failed to rehash password", slog.Any("user_id", userID), slog.Any("error", err))
+		return
+	}
+	if err := a.db.UpdateUserPassword(ctx, database.UpdateUserPasswordParams{
+		ID:           userID,
+		PasswordHash: hashedPassword,
+	}); err != nil {
+		slog.Error("failed to store rehashed password", slog.Any("user_id", userID), slog.Any("error", err))
 	}
-	return string(hashedPassword), nil
+	a.forgetUser(userID)
+}
+
+// HashPassword hashes a plain text password with the configured algorithm
+func (a *AuthService) HashPassword(password string) (string, error) {
+	return a.hasher.Hash(password)
 }
 
-// ComparePassword compares a plain text password with a bcrypt hash
+// ComparePassword compares a plain text password with a stored hash
 func (a *AuthService) ComparePassword(hashedPassword, password string) error {
-	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+	ok, _, err := a.hasher.Verify(hashedPassword, password)
 	if err != nil {
-		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
-			// Return a generic error to avoid leaking information
-			return ErrInvalidCredentials
-		}
 		return fmt.Errorf("password comparison failed: %w", err)
 	}
+	if !ok {
+		// Return a generic error to avoid leaking information
+		return ErrInvalidCredentials
+	}
 	return nil
 }
 
 // Session constants
 const (
-	SessionName = "app-session"
-	UserIDKey   = "user_id"
-	UsernameKey = "username"
-	IsAuthKey   = "authenticated"
+	SessionName   = "app-session"
+	UserIDKey     = "user_id"
+	UsernameKey   = "username"
+	IsAuthKey     = "authenticated"
+	IsVerifiedKey = "verified"
+	SessionIDKey  = "session_id"
+	ReturnToKey   = "return_to"
+	RememberMeKey = "remember_me"
+
+	// Set between a correct password and a correct second factor
+	PendingUserIDKey   = "pending_2fa_user_id"
+	PendingSinceKey    = "pending_2fa_since"
+	PendingAttemptsKey = "pending_2fa_attempts"
+
+	// Set while an admin is signed in as someone else: the admin's user ID
+	ImpersonatorIDKey = "impersonator_id"
 )
 
-// AuthMiddleware checks if user is authenticated
-func AuthMiddleware() echo.MiddlewareFunc {
+// AuthMiddleware checks if user is authenticated. Browsers are sent to the login page;
+// API, JSON and htmx callers get a 401.
+func AuthMiddleware(authService *AuthService) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			sess, err := session.Get(SessionName, c)
 			if err != nil {
-				return c.Redirect(http.StatusFound, "/login")
+				return unauthenticated(c, "Authentication required")
 			}
 
 			// Check if user is authenticated
 			authenticated, ok := sess.Values[IsAuthKey].(bool)
 			if !ok || !authenticated {
-				return c.Redirect(http.StatusFound, "/login")
+				return unauthenticated(c, "Authentication required")
+			}
+
+			// A password alone is not enough once two-factor is enabled
+			if _, pending := sess.Values[PendingUserIDKey]; pending {
+				if wantsJSONError(c) {
+					return unauthenticated(c, "Two-factor authentication required")
+				}
+				return c.Redirect(http.StatusFound, "/login/2fa")
+			}
+
+			// Check the login has not been revoked server-side or timed out
+			sessionID, _ := sess.Values[SessionIDKey].(string)
+			if _, err := authService.CheckSession(c.Request().Context(), sessionID, c.RealIP()); err != nil {
+				switch {
+				case errors.Is(err, ErrSessionExpired):
+					endLogin(c, sess)
+					return unauthenticated(c, "Session expired, please sign in again")
+				case errors.Is(err, ErrSessionNotFound):
+					endLogin(c, sess)
+					return unauthenticated(c, "Session expired or signed out")
+				}
+				slog.Error("failed to check session", slog.Any("error", err))
+				return c.JSON(http.StatusInternalServerError, map[string]string{
+					"error": "Failed to load session",
+				})
 			}
 
-			// Optional: Add user info to context for easy access
-			if userID, ok := sess.Values[UserIDKey].(int32); ok {
-				c.Set("user_id", userID)
+			// The user's roles have changed since this login began
+			rotate, err := authService.claimSessionRotation(c.Request().Context(), sessionID)
+			if err != nil {
+				slog.Error("failed to check session rotation", slog.Any("error", err))
 			}
-			if username, ok := sess.Values[UsernameKey].(string); ok {
-				c.Set("username", username)
+			if rotate {
+				if err := regenerateSession(c, sess); err == nil {
+					err = sess.Save(c.Request(), c.Response())
+				}
+				if err != nil {
+					slog.Error("failed to rotate session", slog.Any("error", err))
+					return c.JSON(http.StatusInternalServerError, map[string]string{
+						"error": "Failed to save session",
+					})
+				}
 			}
 
+			// Load the account itself, so a deactivated or deleted user's session stops working
+			userID, _ := sess.Values[UserIDKey].(int32)
+			user, err := authService.CurrentUser(c.Request().Context(), userID)
+			if err != nil {
+				if !errors.Is(err, ErrUserNotFound) {
+					slog.Error("failed to load current user", slog.Any("error", err))
+					return c.JSON(http.StatusInternalServerError, map[string]string{
+						"error": "Failed to load user",
+					})
+				}
+				if err := authService.RevokeSession(c.Request().Context(), sessionID); err != nil {
+					slog.Error("failed to revoke session", slog.Any("error", err))
+				}
+				endLogin(c, sess)
+				return unauthenticated(c, "Account is no longer active")
+			}
+
+			// An admin viewing the site as this user is the one acting, whatever the session shows
+			actorID := user.ID
+			if adminID, ok := impersonatorID(sess); ok {
+				admin, err := authService.impersonator(c.Request().Context(), adminID)
+				if err != nil {
+					if !errors.Is(err, ErrUserNotFound) && !errors.Is(err, ErrImpersonationDenied) {
+						slog.Error("failed to load impersonator", slog.Any("error", err))
+						return c.JSON(http.StatusInternalServerError, map[string]string{
+							"error": "Failed to load user",
+						})
+					}
+					if err := authService.RevokeSession(c.Request().Context(), sessionID); err != nil {
+						slog.Error("failed to revoke session", slog.Any("error", err))
+					}
+					endLogin(c, sess)
+					return unauthenticated(c, "Impersonation has ended")
+				}
+				c.Set(impersonatorContextKey, admin)
+				actorID = admin.ID
+				showImpersonationBanner(c, admin, user)
+			}
+
+			// Add user info to context for easy access; the loaded user is fresher than the session
+			c.Set(authServiceContextKey, authService)
+			c.Set(currentUserContextKey, user)
+			c.Set(IsVerifiedKey, database.PgBoolToBool(user.IsVerified))
+			c.Set("user_id", user.ID)
+			c.Set("username", user.Username)
+			setEventActor(c, actorID)
+
 			return next(c)
 		}
 	}
 }
 
-// Middleware to redirect authenticated users away from login/register
-func GuestOnlyMiddleware() echo.MiddlewareFunc {
+// Middleware to redirect authenticated users away from login/register. The cookie's flag is
+// confirmed against the server-side login, so a revoked or expired one gets the login page.
+func GuestOnlyMiddleware(authService *AuthService) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			sess, err := session.Get(SessionName, c)
 			if err == nil {
 				if authenticated, ok := sess.Values[IsAuthKey].(bool); ok && authenticated {
-					return c.Redirect(http.StatusFound, "/dashboard")
+					sessionID, _ := sess.Values[SessionIDKey].(string)
+					if _, err := authService.CheckSession(c.Request().Context(), sessionID, c.RealIP()); err != nil {
+						if !errors.Is(err, ErrSessionExpired) && !errors.Is(err, ErrSessionNotFound) {
+							slog.Error("failed to check session", slog.Any("error", err))
+							return c.JSON(http.StatusInternalServerError, map[string]string{
+								"error": "Failed to load session",
+							})
+						}
+						endLogin(c, sess)
+						return next(c)
+					}
+					if wantsJSONError(c) {
+						return c.JSON(http.StatusForbidden, map[string]string{
+							"error":    "Already signed in",
+							"redirect": defaultLoginRedirect,
+						})
+					}
+					target := safeNext(c.QueryParam("next"))
+					if target == "" {
+						target = defaultLoginRedirect
+					}
+					return c.Redirect(http.StatusFound, target)
 				}
 			}
 			return next(c)
@@ -125,22 +326,35 @@ func GuestOnlyMiddleware() echo.MiddlewareFunc {
 // Auth handlers
 type AuthHandlers struct {
 	authService *AuthService
+	passkeys    *PasskeyService
+	oidc        *OIDCService
 }
 
-func NewAuthHandlers(authService *AuthService) *AuthHandlers {
-	return &AuthHandlers{authService: authService}
+func NewAuthHandlers(authService *AuthService, passkeys *PasskeyService, oidc *OIDCService) *AuthHandlers {
+	return &AuthHandlers{authService: authService, passkeys: passkeys, oidc: oidc}
 }
 
 // Login form (GET)
 func (h *AuthHandlers) ShowLogin(c echo.Context) error {
+	// Remember where to go once any of the login methods below succeeds
+	if sess, err := session.Get(SessionName, c); err == nil {
+		rememberReturnTo(sess, c.QueryParam("next"))
+		if err := sess.Save(c.Request(), c.Response()); err != nil {
+			slog.Error("failed to save session", slog.Any("error", err))
+		}
+	}
+
 	// In a real app, render your login template
 	return c.HTML(http.StatusOK, `
 		<form method="POST" action="/login">
-			<input type="text" name="username" placeholder="Username" required>
+			`+csrfField(c)+`
+			<input type="text" name="username" placeholder="Username or email" autocomplete="username" required>
 			<input type="password" name="password" placeholder="Password" required>
+			<label><input type="checkbox" name="remember" value="true"> Remember me</label>
 			<button type="submit">Login</button>
 		</form>
-	`)
+		<p><a href="/login/passkey">Sign in with a passkey</a></p>
+	`+h.oidcLoginLinks())
 }
 
 // Login handler (POST)
@@ -150,13 +364,20 @@ func (h *AuthHandlers) Login(c echo.Context) error {
 
 	if username == "" || password == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Username and password are required",
+			"error": "Username or email and password are required",
 		})
 	}
 
-	// Validate credentials
-	user, err := h.authService.ValidateCredentials(c.Request().Context(), username, password)
+	// Validate credentials, subject to per-username and per-IP throttling
+	user, err := h.authService.Authenticate(c.Request().Context(), username, password, c.RealIP())
 	if err != nil {
+		var throttled *ThrottledError
+		if errors.As(err, &throttled) {
+			return throttledResponse(c, throttled)
+		}
+		if !errors.Is(err, ErrInvalidCredentials) {
+			slog.Error("login failed", slog.Any("error", err))
+		}
 		return c.JSON(http.StatusUnauthorized, map[string]string{
 			"error": "Invalid credentials",
 		})
@@ -170,30 +391,88 @@ func (h *AuthHandlers) Login(c echo.Context) error {
 		})
 	}
 
-	slog.Info("User info is", slog.Any("id", user.ID), slog.Any("username", user.Username))
+	// Carried through the second factor, if there is one, to startSession
+	remember, _ := strconv.ParseBool(c.FormValue("remember"))
+	sess.Values[RememberMeKey] = remember
+
+	// Hold the login until the second factor has been checked
+	twoFactor, err := h.authService.TwoFactorEnabled(c.Request().Context(), user.ID)
+	if err != nil {
+		slog.Error("failed to check two-factor status", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to create session",
+		})
+	}
+	if twoFactor {
+		return h.beginTwoFactorLogin(c, sess, user)
+	}
+
+	return h.completeLogin(c, sess, user, "password")
+}
+
+// completeLogin marks the session authenticated for user and sends them on to the page they
+// were trying to reach, or the dashboard
+func (h *AuthHandlers) completeLogin(c echo.Context, sess *sessions.Session, user *database.User, method string) error {
+	redirect := takeReturnTo(sess)
+	if err := h.startSession(c, sess, user, method); err != nil {
+		slog.Error("failed to start session", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to create session",
+		})
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, map[string]string{
+			"message":  "Logged in",
+			"redirect": redirect,
+		})
+	}
+	return c.Redirect(http.StatusFound, redirect)
+}
+
+// startSession records the login server-side and saves the authenticated session cookie
+// under a new session ID, so one fixed before login is never authenticated. method names the
+// way the user signed in, for the security event log.
+func (h *AuthHandlers) startSession(c echo.Context, sess *sessions.Session, user *database.User, method string) error {
+	remember, _ := sess.Values[RememberMeKey].(bool)
+
+	// Record the login so it can be revoked server-side
+	sessionID, err := h.authService.CreateSession(c.Request().Context(), user.ID, c.RealIP(), c.Request().UserAgent(), remember)
+	if err != nil {
+		return err
+	}
+
+	if err := regenerateSession(c, sess); err != nil {
+		return err
+	}
+	if err := rotateCSRFToken(c, sess); err != nil {
+		return err
+	}
 
 	// Set session values
+	clearPendingTwoFactor(sess)
 	sess.Values[IsAuthKey] = true
 	sess.Values[UserIDKey] = user.ID
 	sess.Values[UsernameKey] = user.Username
+	sess.Values[IsVerifiedKey] = database.PgBoolToBool(user.IsVerified)
+	sess.Values[SessionIDKey] = sessionID
 
-	// Configure session options
-	sess.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   86400 * 7, // 7 days
-		HttpOnly: true,
-		Secure:   false, // Set to true in production with HTTPS
-		SameSite: http.SameSiteStrictMode,
-	}
+	// The cookie lasts as long as the login can; CheckSession enforces the idle timeout
+	_, absolute := h.authService.sessions.Lifetimes(remember)
+	sess.Options = h.authService.sessions.CookieOptions("/", absolute)
 
 	// Save session
 	if err := sess.Save(c.Request(), c.Response()); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to save session",
-		})
+		return fmt.Errorf("failed to save session: %w", err)
 	}
 
-	return c.Redirect(http.StatusFound, "/dashboard")
+	h.authService.clearLoginThrottle(c.Request().Context(), user)
+	h.authService.recordSecurityEvent(c.Request().Context(), EventLoginSucceeded,
+		slog.Any("user_id", user.ID),
+		slog.String("method", method),
+		slog.Bool("remember", remember),
+	)
+	return nil
 }
 
 // Logout handler
@@ -204,10 +483,28 @@ func (h *AuthHandlers) Logout(c echo.Context) error {
 		return c.Redirect(http.StatusFound, "/login")
 	}
 
+	if sessionID, ok := sess.Values[SessionIDKey].(string); ok {
+		if err := h.authService.RevokeSession(c.Request().Context(), sessionID); err != nil {
+			slog.Error("failed to revoke session", slog.Any("error", err))
+		}
+	}
+	if admin := GetImpersonator(c); admin != nil {
+		h.authService.recordSecurityEvent(c.Request().Context(), EventImpersonationEnded,
+			slog.Any("user_id", c.Get("user_id")),
+			slog.Any("actor_id", admin.ID),
+			slog.String("reason", "logout"),
+		)
+	}
+	h.authService.recordSecurityEvent(c.Request().Context(), EventLogout, slog.Any("user_id", c.Get("user_id")))
+
 	// Clear session values
 	sess.Values[IsAuthKey] = false
+	delete(sess.Values, ImpersonatorIDKey)
 	delete(sess.Values, UserIDKey)
 	delete(sess.Values, UsernameKey)
+	delete(sess.Values, IsVerifiedKey)
+	delete(sess.Values, SessionIDKey)
+	clearPendingTwoFactor(sess)
 
 	// Set MaxAge to -1 to delete the session
 	sess.Options.MaxAge = -1
@@ -226,26 +523,3 @@ func Dashboard(c echo.Context) error {
 		"message": fmt.Sprintf("Welcome to dashboard, %s, id: %d", username, userID),
 	})
 }
-
-// Helper function to get current user from session
-func GetCurrentUser(c echo.Context) (*database.User, error) {
-	sess, err := session.Get(SessionName, c)
-	if err != nil {
-		return nil, err
-	}
-
-	userID, ok := sess.Values[UserIDKey].(int32)
-	if !ok {
-		return nil, fmt.Errorf("user not found in session")
-	}
-
-	username, ok := sess.Values[UsernameKey].(string)
-	if !ok {
-		return nil, fmt.Errorf("username not found in session")
-	}
-
-	return &database.User{
-		ID:       int32(userID),
-		Username: username,
-	}, nil
-}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// CSRF token transport. Forms post the token in a hidden field; fetch and htmx callers send
+// it in a header, reading it from the header of the same name on any earlier response.
+const (
+	CSRFTokenKey  = "csrf_token"
+	CSRFHeader    = "X-CSRF-Token"
+	CSRFFormField = "_csrf"
+
+	csrfContextKey = "csrf_token"
+)
+
+// CSRFMiddleware protects state-changing requests with a synchronizer token kept in the
+// session. Safe methods are let through; anything else must send the token back. A visitor
+// without a session is only given a token, and so a session, once a page renders a form for
+// them (see csrfToken), so crawlers and health checks do not each leave a session behind.
+// Requests authenticated with an API token are exempt, since browsers never attach one on their own.
+func CSRFMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if bearerAuthenticated(c) {
+				return next(c)
+			}
+
+			sess, err := session.Get(SessionName, c)
+			if err != nil {
+				slog.Error("failed to load session for CSRF check", slog.Any("error", err))
+				return c.JSON(http.StatusInternalServerError, map[string]string{
+					"error": "Failed to load session",
+				})
+			}
+
+			token, _ := sess.Values[CSRFTokenKey].(string)
+			if token == "" && !sess.IsNew {
+				if token, err = issueCSRFToken(c, sess); err != nil {
+					slog.Error("failed to issue CSRF token", slog.Any("error", err))
+					return c.JSON(http.StatusInternalServerError, map[string]string{
+						"error": "Failed to load session",
+					})
+				}
+			}
+			if token != "" {
+				c.Set(csrfContextKey, token)
+				c.Response().Header().Set(CSRFHeader, token)
+			}
+
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+				return next(c)
+			}
+
+			sent := c.Request().Header.Get(CSRFHeader)
+			if sent == "" {
+				sent = c.FormValue(CSRFFormField)
+			}
+			if sent == "" || token == "" {
+				return csrfRejected(c, "Missing CSRF token")
+			}
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				return csrfRejected(c, "Invalid CSRF token")
+			}
+			return next(c)
+		}
+	}
+}
+
+// issueCSRFToken gives the session a token and saves it
+func issueCSRFToken(c echo.Context, sess *sessions.Session) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	sess.Values[CSRFTokenKey] = token
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return "", err
+	}
+	c.Set(csrfContextKey, token)
+	c.Response().Header().Set(CSRFHeader, token)
+	return token, nil
+}
+
+// rotateCSRFToken replaces the session's token when the user signs in, so one captured
+// from the anonymous session cannot be used against the signed in one
+func rotateCSRFToken(c echo.Context, sess *sessions.Session) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	sess.Values[CSRFTokenKey] = token
+	c.Set(csrfContextKey, token)
+	c.Response().Header().Set(CSRFHeader, token)
+	return nil
+}
+
+// bearerAuthenticated reports whether an API request carries its own credentials
+func bearerAuthenticated(c echo.Context) bool {
+	if !strings.HasPrefix(c.Request().URL.Path, "/api/") {
+		return false
+	}
+	scheme, _, ok := strings.Cut(c.Request().Header.Get(echo.HeaderAuthorization), " ")
+	return ok && strings.EqualFold(scheme, "Bearer")
+}
+
+// csrfRejected explains a failed CSRF check, in JSON for API and script callers
+func csrfRejected(c echo.Context, reason string) error {
+	slog.Warn("CSRF check failed", slog.String("reason", reason), slog.String("path", c.Request().URL.Path), slog.String("ip", c.RealIP()))
+	if wantsJSON(c) {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": reason,
+			"hint":  fmt.Sprintf("Send the token from the %s response header in a %s request header", CSRFHeader, CSRFHeader),
+		})
+	}
+	return c.HTML(http.StatusForbidden, `
+		<p>This form has expired or was submitted from another site.</p>
+		<p>Go back, reload the page and try again.</p>
+	`)
+}
+
+// csrfToken returns the request's token, issuing one and saving the session if CSRFMiddleware
+// left the visitor without. It must be called before the response is written.
+func csrfToken(c echo.Context) string {
+	if token, _ := c.Get(csrfContextKey).(string); token != "" {
+		return token
+	}
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		slog.Error("failed to load session for CSRF token", slog.Any("error", err))
+		return ""
+	}
+	token, err := issueCSRFToken(c, sess)
+	if err != nil {
+		slog.Error("failed to issue CSRF token", slog.Any("error", err))
+		return ""
+	}
+	return token
+}
+
+// csrfField is the hidden input every rendered form must include
+func csrfField(c echo.Context) string {
+	return fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, CSRFFormField, html.EscapeString(csrfToken(c)))
+}
+
+// csrfScript exposes the token to page scripts and adds it to every same-origin fetch.
+// The meta tag also lets htmx pages send it with hx-headers.
+func csrfScript(c echo.Context) string {
+	return fmt.Sprintf(`
+		<meta name="csrf-token" content="%s">
+		<script>
+		(() => {
+			const token = document.querySelector('meta[name="csrf-token"]').content;
+			const send = window.fetch;
+			window.fetch = (input, init = {}) => {
+				const url = new URL(input instanceof Request ? input.url : input, location.href);
+				if (url.origin === location.origin) {
+					init.headers = new Headers(init.headers || (input instanceof Request ? input.headers : undefined));
+					init.headers.set('%s', token);
+				}
+				return send(input, init);
+			};
+		})();
+		</script>
+	`, html.EscapeString(csrfToken(c)), CSRFHeader)
+}
@@ -0,0 +1,384 @@
+package auth
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/labstack/echo/v4"
+)
+
+// Security event types
+const (
+	EventLoginSucceeded           = "login_succeeded"
+	EventLoginFailed              = "login_failed"
+	EventLogout                   = "logout"
+	EventLoginLockout             = "login_lockout"
+	EventLoginUnlocked            = "login_unlocked"
+	EventTwoFactorFailed          = "two_factor_failed"
+	EventTwoFactorEnabled         = "two_factor_enabled"
+	EventTwoFactorDisabled        = "two_factor_disabled"
+	EventRecoveryCodesRegenerated = "recovery_codes_regenerated"
+	EventRecoveryCodeUsed         = "recovery_code_used"
+	EventPasswordChanged          = "password_changed"
+	EventRoleGranted              = "role_granted"
+	EventRoleRevoked              = "role_revoked"
+	EventRolePermissionGranted    = "role_permission_granted"
+	EventRolePermissionRevoked    = "role_permission_revoked"
+	EventAPITokenCreated          = "api_token_created"
+	EventAPITokenRevoked          = "api_token_revoked"
+	EventImpersonationStarted     = "impersonation_started"
+	EventImpersonationEnded       = "impersonation_ended"
+)
+
+// Events that are also logged as warnings, since they may mean an attack in progress
+var alertEvents = map[string]bool{
+	EventLoginFailed:     true,
+	EventLoginLockout:    true,
+	EventTwoFactorFailed: true,
+}
+
+// Page sizes for the admin event log
+const (
+	defaultEventsPerPage = 50
+	maxEventsPerPage     = 500
+)
+
+type requestInfoContextKey struct{}
+
+// requestInfo describes who made a request, for the security events it causes
+type requestInfo struct {
+	ip        string
+	userAgent string
+	actorID   int32 // the signed in user, 0 until authenticated
+}
+
+// RequestInfoMiddleware makes the caller's address and user agent available to the security
+// events recorded while handling the request
+func RequestInfoMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			userAgent := c.Request().UserAgent()
+			if len(userAgent) > 512 {
+				userAgent = userAgent[:512]
+			}
+			setRequestInfo(c, requestInfo{ip: c.RealIP(), userAgent: userAgent})
+			return next(c)
+		}
+	}
+}
+
+func setRequestInfo(c echo.Context, info requestInfo) {
+	req := c.Request()
+	c.SetRequest(req.WithContext(context.WithValue(req.Context(), requestInfoContextKey{}, info)))
+}
+
+func requestInfoFrom(ctx context.Context) requestInfo {
+	info, _ := ctx.Value(requestInfoContextKey{}).(requestInfo)
+	return info
+}
+
+// setEventActor records the authenticated user as the actor of later events in the request
+func setEventActor(c echo.Context, userID int32) {
+	info := requestInfoFrom(c.Request().Context())
+	info.actorID = userID
+	setRequestInfo(c, info)
+}
+
+// recordSecurityEvent logs a security-relevant event and appends it to the security event log.
+// "user_id" and "actor_id" attributes fill the columns of the same name; the actor defaults to
+// the signed in user. Other attributes are stored as JSON details. Failing to store the event
+// is logged but never fails the action itself.
+func (a *AuthService) recordSecurityEvent(ctx context.Context, event string, attrs ...slog.Attr) {
+	info := requestInfoFrom(ctx)
+
+	level := slog.LevelInfo
+	if alertEvents[event] {
+		level = slog.LevelWarn
+	}
+	slog.LogAttrs(ctx, level, "security event", append([]slog.Attr{slog.String("event", event), slog.String("ip", info.ip)}, attrs...)...)
+
+	params := database.CreateSecurityEventParams{
+		Event:     event,
+		IpAddress: database.StringToPgText(info.ip),
+		UserAgent: database.StringToPgText(info.userAgent),
+	}
+	if info.actorID != 0 {
+		params.ActorID = database.Int32ToPgInt4(info.actorID)
+	}
+	details := map[string]any{}
+	for _, attr := range attrs {
+		value := attr.Value.Resolve()
+		switch {
+		case attr.Key == "user_id" && value.Kind() == slog.KindInt64:
+			params.UserID = database.Int32ToPgInt4(int32(value.Int64()))
+		case attr.Key == "actor_id" && value.Kind() == slog.KindInt64:
+			params.ActorID = database.Int32ToPgInt4(int32(value.Int64()))
+		default:
+			details[attr.Key] = value.Any()
+		}
+	}
+
+	var err error
+	if params.Details, err = json.Marshal(details); err != nil {
+		slog.Error("failed to encode security event", slog.String("event", event), slog.Any("error", err))
+		params.Details = []byte("{}")
+	}
+	// Still record the event if the client has gone away mid-request
+	if err := a.db.CreateSecurityEvent(context.WithoutCancel(ctx), params); err != nil {
+		slog.Error("failed to store security event", slog.String("event", event), slog.Any("error", err))
+	}
+}
+
+// SecurityEventFilter selects events from the security event log
+type SecurityEventFilter struct {
+	Event   string
+	UserID  int32 // matches events about or by the user
+	IP      string
+	Since   time.Time // inclusive
+	Until   time.Time // exclusive
+	Page    int
+	PerPage int
+}
+
+func (f SecurityEventFilter) params() database.ListSecurityEventsParams {
+	params := database.ListSecurityEventsParams{
+		Event:     database.StringToPgText(f.Event),
+		IpAddress: database.StringToPgText(f.IP),
+	}
+	if f.UserID != 0 {
+		params.UserID = database.Int32ToPgInt4(f.UserID)
+	}
+	if !f.Since.IsZero() {
+		params.Since = database.TimeToPgTimestamptz(f.Since)
+	}
+	if !f.Until.IsZero() {
+		params.Until = database.TimeToPgTimestamptz(f.Until)
+	}
+	return params
+}
+
+// ListSecurityEvents returns one page of events matching filter, newest first, and the total number of matches
+func (a *AuthService) ListSecurityEvents(ctx context.Context, filter SecurityEventFilter) ([]database.SecurityEvent, int64, error) {
+	params := filter.params()
+	total, err := a.db.CountSecurityEvents(ctx, database.CountSecurityEventsParams{
+		Event:     params.Event,
+		UserID:    params.UserID,
+		IpAddress: params.IpAddress,
+		Since:     params.Since,
+		Until:     params.Until,
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count security events: %w", err)
+	}
+
+	params.PageLimit = int32(filter.PerPage)
+	params.PageOffset = int32((filter.Page - 1) * filter.PerPage)
+	events, err := a.db.ListSecurityEvents(ctx, params)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list security events: %w", err)
+	}
+	return events, total, nil
+}
+
+// EachSecurityEvent calls fn for every event matching filter, newest first, ignoring its
+// paging. Events recorded after the call starts are left out so that pages do not shift.
+func (a *AuthService) EachSecurityEvent(ctx context.Context, filter SecurityEventFilter, fn func(database.SecurityEvent) error) error {
+	if filter.Until.IsZero() || filter.Until.After(time.Now()) {
+		filter.Until = time.Now()
+	}
+	params := filter.params()
+	params.PageLimit = maxEventsPerPage
+	for {
+		events, err := a.db.ListSecurityEvents(ctx, params)
+		if err != nil {
+			return fmt.Errorf("failed to list security events: %w", err)
+		}
+		for _, event := range events {
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+		if len(events) < maxEventsPerPage {
+			return nil
+		}
+		params.PageOffset += maxEventsPerPage
+	}
+}
+
+// PruneSecurityEvents deletes events older than retention and returns how many were removed
+func (a *AuthService) PruneSecurityEvents(ctx context.Context, retention time.Duration) (int64, error) {
+	n, err := a.db.DeleteSecurityEventsBefore(ctx, database.TimeToPgTimestamptz(time.Now().Add(-retention)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune security events: %w", err)
+	}
+	return n, nil
+}
+
+// RunSecurityEventRetention prunes events older than retention now and then every interval,
+// until ctx is cancelled
+func (a *AuthService) RunSecurityEventRetention(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := a.PruneSecurityEvents(ctx, retention); err != nil {
+			slog.Error("security event retention failed", slog.Any("error", err))
+		} else if n > 0 {
+			slog.Info("pruned security events", slog.Int64("deleted", n), slog.Duration("retention", retention))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// securityEventFilter reads the filter shared by the list and export endpoints
+func securityEventFilter(c echo.Context) (SecurityEventFilter, error) {
+	filter := SecurityEventFilter{
+		Event:   strings.TrimSpace(c.QueryParam("event")),
+		IP:      strings.TrimSpace(c.QueryParam("ip")),
+		Page:    1,
+		PerPage: defaultEventsPerPage,
+	}
+	if page, err := strconv.Atoi(c.QueryParam("page")); err == nil && page > 0 {
+		filter.Page = page
+	}
+	if perPage, err := strconv.Atoi(c.QueryParam("per_page")); err == nil && perPage > 0 {
+		filter.PerPage = min(perPage, maxEventsPerPage)
+	}
+
+	errs := ValidationErrors{}
+	if value := c.QueryParam("user_id"); value != "" {
+		userID, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || userID <= 0 {
+			errs["user_id"] = "User ID must be a positive number"
+		}
+		filter.UserID = int32(userID)
+	}
+	for field, dest := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		value := c.QueryParam(field)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			// A bare date is a whole day in UTC, and both ends include it: since starts at
+			// its midnight and until stops at the next one
+			if t, err = time.Parse(time.DateOnly, value); err != nil {
+				errs[field] = "Use an RFC 3339 time or a YYYY-MM-DD date"
+				continue
+			}
+			if field == "until" {
+				t = t.AddDate(0, 0, 1)
+			}
+		}
+		*dest = t
+	}
+
+	if len(errs) > 0 {
+		return filter, errs
+	}
+	return filter, nil
+}
+
+// List the security event log (GET)
+func (h *AuthHandlers) ListSecurityEvents(c echo.Context) error {
+	filter, err := securityEventFilter(c)
+	if err != nil {
+		return securityEventError(c, err)
+	}
+
+	rows, total, err := h.authService.ListSecurityEvents(c.Request().Context(), filter)
+	if err != nil {
+		return securityEventError(c, err)
+	}
+
+	events := make([]SecurityEventResponse, 0, len(rows))
+	for _, row := range rows {
+		events = append(events, NewSecurityEventResponse(row))
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"events":   events,
+		"total":    total,
+		"page":     filter.Page,
+		"per_page": filter.PerPage,
+	})
+}
+
+// Download the security event log as CSV (GET)
+func (h *AuthHandlers) ExportSecurityEvents(c echo.Context) error {
+	filter, err := securityEventFilter(c)
+	if err != nil {
+		return securityEventError(c, err)
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="security-events-%s.csv"`, time.Now().UTC().Format("20060102-150405")))
+	res.WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(res)
+	w.Write([]string{"id", "created_at", "event", "user_id", "actor_id", "ip_address", "user_agent", "details"})
+	err = h.authService.EachSecurityEvent(c.Request().Context(), filter, func(event database.SecurityEvent) error {
+		return w.Write([]string{
+			strconv.FormatInt(event.ID, 10),
+			event.CreatedAt.Time.UTC().Format(time.RFC3339),
+			csvSafe(event.Event),
+			pgInt4String(event.UserID),
+			pgInt4String(event.ActorID),
+			csvSafe(database.PgTextToString(event.IpAddress)),
+			csvSafe(database.PgTextToString(event.UserAgent)),
+			csvSafe(string(event.Details)),
+		})
+	})
+	w.Flush()
+	if err == nil {
+		err = w.Error()
+	}
+	if err != nil {
+		// The status has been sent, so all that is left is to cut the file short
+		slog.Error("failed to export security events", slog.Any("error", err))
+	}
+	return nil
+}
+
+// csvSafe stops spreadsheet programs treating a user-supplied value, such as a user agent, as a formula
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func pgInt4String(value pgtype.Int4) string {
+	if !value.Valid {
+		return ""
+	}
+	return strconv.Itoa(int(value.Int32))
+}
+
+func securityEventError(c echo.Context, err error) error {
+	var validationErrs ValidationErrors
+	if errors.As(err, &validationErrs) {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":  "Invalid filter",
+			"fields": validationErrs,
+		})
+	}
+	slog.Error("failed to read security events", slog.Any("error", err))
+	return c.JSON(http.StatusInternalServerError, map[string]string{
+		"error": "Failed to read security events",
+	})
+}
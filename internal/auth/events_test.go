@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSecurityEventFilterDates(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, time.October, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name      string
+		query     string
+		wantSince time.Time
+		wantUntil time.Time
+		wantErr   bool
+	}{
+		{"none", "", time.Time{}, time.Time{}, false},
+		{"since a date starts that day", "since=2026-10-17", day(17), time.Time{}, false},
+		{"until a date includes that day", "until=2026-10-17", time.Time{}, day(18), false},
+		{"one whole day", "since=2026-10-17&until=2026-10-17", day(17), day(18), false},
+		{"until the last day of a month", "until=2026-10-31", time.Time{}, time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC), false},
+		{"until an exact time is kept", "until=2026-10-17T12:30:00Z", time.Time{}, day(17).Add(12*time.Hour + 30*time.Minute), false},
+		{"malformed", "until=17/10/2026", time.Time{}, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/events?"+tt.query, nil)
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+
+			filter, err := securityEventFilter(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !filter.Since.Equal(tt.wantSince) || !filter.Until.Equal(tt.wantUntil) {
+				t.Errorf("since, until = %v, %v, want %v, %v", filter.Since, filter.Until, tt.wantSince, tt.wantUntil)
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// fakeDB is an in-memory database.DBTX covering the queries the handler tests reach. Queries it
+// does not know about find no rows and change nothing.
+type fakeDB struct {
+	mu       sync.Mutex
+	nextID   int32
+	users    map[int32]*database.User
+	sessions map[string]*database.UserSession
+	// Each user's roles and the permissions they come with
+	roles       map[int32][]string
+	permissions map[int32][]string
+	totp        map[int32]*database.UserTotp
+	passkeys    map[string]*database.WebauthnCredential // by credential ID
+	events      []string
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		nextID:      1,
+		users:       map[int32]*database.User{},
+		sessions:    map[string]*database.UserSession{},
+		roles:       map[int32][]string{},
+		permissions: map[int32][]string{},
+		totp:        map[int32]*database.UserTotp{},
+		passkeys:    map[string]*database.WebauthnCredential{},
+	}
+}
+
+// newTestAuthService returns an AuthService on a fresh fakeDB, hashing cheaply and setting
+// cookies that work over plain HTTP
+func newTestAuthService(t *testing.T) (*AuthService, *fakeDB) {
+	t.Helper()
+	db := newFakeDB()
+	sessionCfg := DefaultSessionConfig()
+	sessionCfg.CookieSecure = false
+	sessionCfg.CookieSameSite = 0
+	return NewAuthService(database.New(db), nil, Config{
+		BaseURL:   "http://example.test",
+		SecretKey: []byte("test-secret"),
+		Hasher:    newTestHasher(t, HasherConfig{Algorithm: HashArgon2id, Argon2: testArgon2Params}),
+		Sessions:  sessionCfg,
+	}), db
+}
+
+// addUser stores an active, verified user with password
+func (f *fakeDB) addUser(t *testing.T, a *AuthService, username, password string) *database.User {
+	t.Helper()
+	hash, err := a.HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := pgtype.Timestamptz{Time: time.Now(), Valid: true}
+	user := &database.User{
+		ID:           f.nextID,
+		Username:     username,
+		Email:        username + "@example.test",
+		PasswordHash: hash,
+		IsActive:     pgtype.Bool{Bool: true, Valid: true},
+		IsVerified:   pgtype.Bool{Bool: true, Valid: true},
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	f.users[user.ID] = user
+	f.nextID++
+	return user
+}
+
+// sessionIDs returns the IDs of userID's recorded logins
+func (f *fakeDB) sessionIDs(userID int32) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []string
+	for id, s := range f.sessions {
+		if s.UserID == userID {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// grant gives userID role, carrying permissions
+func (f *fakeDB) grant(userID int32, role string, permissions ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.roles[userID] = append(f.roles[userID], role)
+	f.permissions[userID] = append(f.permissions[userID], permissions...)
+}
+
+// user returns a copy of the stored user
+func (f *fakeDB) user(userID int32) database.User {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return *f.users[userID]
+}
+
+func (f *fakeDB) setActive(userID int32, active bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users[userID].IsActive = pgtype.Bool{Bool: active, Valid: true}
+}
+
+var queryNamePattern = regexp.MustCompile(`^-- name: (\w+)`)
+
+func queryName(sql string) string {
+	if m := queryNamePattern.FindStringSubmatch(sql); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+func (f *fakeDB) Exec(_ context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	switch queryName(sql) {
+	case "CreateUserSession":
+		id := args[0].(string)
+		f.sessions[id] = &database.UserSession{
+			ID:         id,
+			UserID:     args[1].(int32),
+			CreatedAt:  pgtype.Timestamptz{Time: time.Now(), Valid: true},
+			LastSeenAt: pgtype.Timestamptz{Time: time.Now(), Valid: true},
+			IpAddress:  args[2].(pgtype.Text),
+			UserAgent:  args[3].(pgtype.Text),
+			ExpiresAt:  args[4].(pgtype.Timestamptz),
+			Remember:   args[5].(bool),
+		}
+		n = 1
+	case "DeleteUserSession":
+		if _, ok := f.sessions[args[0].(string)]; ok {
+			delete(f.sessions, args[0].(string))
+			n = 1
+		}
+	case "DeleteUserSessions":
+		for id, s := range f.sessions {
+			if s.UserID == args[0].(int32) {
+				delete(f.sessions, id)
+				n++
+			}
+		}
+	case "UpdateUserPassword":
+		if u, ok := f.users[args[0].(int32)]; ok {
+			u.PasswordHash = args[1].(string)
+			n = 1
+		}
+	case "UpsertPendingUserTOTP":
+		if t, ok := f.totp[args[0].(int32)]; !ok || !t.EnabledAt.Valid {
+			f.totp[args[0].(int32)] = &database.UserTotp{UserID: args[0].(int32), Secret: args[1].(string)}
+			n = 1
+		}
+	case "EnableUserTOTP":
+		if t, ok := f.totp[args[0].(int32)]; ok {
+			t.EnabledAt = pgtype.Timestamptz{Time: time.Now(), Valid: true}
+			n = 1
+		}
+	case "ClaimTOTPStep":
+		step := args[0].(int64)
+		if t, ok := f.totp[args[1].(int32)]; ok && (!t.LastUsedStep.Valid || t.LastUsedStep.Int64 < step) {
+			t.LastUsedStep = pgtype.Int8{Int64: step, Valid: true}
+			n = 1
+		}
+	case "UpdateWebAuthnCredentialUsage":
+		if p, ok := f.passkeys[string(args[0].([]byte))]; ok {
+			p.SignCount, p.BackupState = args[1].(int64), args[2].(bool)
+			p.LastUsedAt = pgtype.Timestamptz{Time: time.Now(), Valid: true}
+			n = 1
+		}
+	case "DeactivateUser":
+		if u, ok := f.users[args[0].(int32)]; ok {
+			u.IsActive = pgtype.Bool{Bool: false, Valid: true}
+			n = 1
+		}
+	case "CreateSecurityEvent":
+		f.events = append(f.events, args[0].(string))
+		n = 1
+	}
+	return pgconn.NewCommandTag(fmt.Sprintf("UPDATE %d", n)), nil
+}
+
+func (f *fakeDB) Query(_ context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rows := &fakeRows{}
+	var names []string
+	switch queryName(sql) {
+	case "ListUserRoles":
+		names = f.roles[args[0].(int32)]
+	case "ListUserPermissions":
+		names = f.permissions[args[0].(int32)]
+	case "ListWebAuthnCredentialsByUser":
+		for _, p := range f.passkeys {
+			if p.UserID == args[0].(int32) {
+				rows.rows = append(rows.rows, fieldValues(*p))
+			}
+		}
+	}
+	for _, name := range names {
+		rows.rows = append(rows.rows, []any{name})
+	}
+	return rows, nil
+}
+
+func (f *fakeDB) QueryRow(_ context.Context, sql string, args ...interface{}) pgx.Row {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch queryName(sql) {
+	case "GetUserByUsername", "GetUserByEmail":
+		for _, u := range f.users {
+			field := u.Username
+			if queryName(sql) == "GetUserByEmail" {
+				field = u.Email
+			}
+			if strings.EqualFold(field, args[0].(string)) && u.IsActive.Bool {
+				return fakeRow{values: fieldValues(*u)}
+			}
+		}
+	case "GetUserByID":
+		if u, ok := f.users[args[0].(int32)]; ok && u.IsActive.Bool {
+			return fakeRow{values: fieldValues(*u)}
+		}
+	case "GetAnyUserByID":
+		if u, ok := f.users[args[0].(int32)]; ok {
+			return fakeRow{values: fieldValues(*u)}
+		}
+	case "UpdateUser":
+		if u, ok := f.users[args[0].(int32)]; ok && u.IsActive.Bool {
+			u.Username, u.Email = args[1].(string), args[2].(string)
+			u.FirstName, u.LastName = args[3].(pgtype.Text), args[4].(pgtype.Text)
+			return fakeRow{values: []any{u.ID, u.Username, u.Email, u.FirstName, u.LastName, u.IsActive, u.IsVerified, u.CreatedAt, u.UpdatedAt}}
+		}
+	case "GetUserTOTP":
+		if t, ok := f.totp[args[0].(int32)]; ok {
+			return fakeRow{values: fieldValues(*t)}
+		}
+	case "CreateWebAuthnCredential":
+		if _, ok := f.passkeys[string(args[1].([]byte))]; !ok {
+			p := &database.WebauthnCredential{
+				ID:              int32(len(f.passkeys) + 1),
+				UserID:          args[0].(int32),
+				CredentialID:    args[1].([]byte),
+				PublicKey:       args[2].([]byte),
+				AttestationType: args[3].(string),
+				Transports:      args[4].([]string),
+				Aaguid:          args[5].([]byte),
+				SignCount:       args[6].(int64),
+				BackupEligible:  args[7].(bool),
+				BackupState:     args[8].(bool),
+				Name:            args[9].(string),
+				CreatedAt:       pgtype.Timestamptz{Time: time.Now(), Valid: true},
+			}
+			f.passkeys[string(p.CredentialID)] = p
+			return fakeRow{values: fieldValues(*p)}
+		}
+		return fakeRow{err: &pgconn.PgError{Code: "23505"}}
+	case "GetWebAuthnCredentialByCredentialID":
+		if p, ok := f.passkeys[string(args[0].([]byte))]; ok {
+			return fakeRow{values: fieldValues(*p)}
+		}
+	case "GetUserSession":
+		if s, ok := f.sessions[args[0].(string)]; ok {
+			return fakeRow{values: fieldValues(*s)}
+		}
+	}
+	return fakeRow{err: pgx.ErrNoRows}
+}
+
+// fieldValues lists a model's fields in declaration order, which is the order sqlc scans them
+func fieldValues(model any) []any {
+	v := reflect.ValueOf(model)
+	values := make([]any, v.NumField())
+	for i := range values {
+		values[i] = v.Field(i).Interface()
+	}
+	return values
+}
+
+func scanValues(values []any, dest []any) error {
+	if len(dest) != len(values) {
+		return fmt.Errorf("scan into %d destinations, have %d values", len(dest), len(values))
+	}
+	for i, d := range dest {
+		reflect.ValueOf(d).Elem().Set(reflect.ValueOf(values[i]))
+	}
+	return nil
+}
+
+type fakeRow struct {
+	values []any
+	err    error
+}
+
+func (r fakeRow) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	return scanValues(r.values, dest)
+}
+
+type fakeRows struct {
+	rows [][]any
+	i    int
+}
+
+func (r *fakeRows) Close()                                       {}
+func (r *fakeRows) Err() error                                   { return nil }
+func (r *fakeRows) CommandTag() pgconn.CommandTag                { return pgconn.NewCommandTag("SELECT") }
+func (r *fakeRows) FieldDescriptions() []pgconn.FieldDescription { return nil }
+func (r *fakeRows) RawValues() [][]byte                          { return nil }
+func (r *fakeRows) Conn() *pgx.Conn                              { return nil }
+
+func (r *fakeRows) Next() bool {
+	if r.i >= len(r.rows) {
+		return false
+	}
+	r.i++
+	return true
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	return scanValues(r.rows[r.i-1], dest)
+}
+
+func (r *fakeRows) Values() ([]any, error) {
+	return r.rows[r.i-1], nil
+}
@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt   = "bcrypt"
+)
+
+// ErrUnknownHash is returned when a stored hash was made by an algorithm this build cannot verify
+var ErrUnknownHash = errors.New("unrecognised password hash format")
+
+// HasherConfig chooses the algorithm and parameters for new password hashes
+type HasherConfig struct {
+	Algorithm  string // HashArgon2id (default) or HashBcrypt
+	Argon2     Argon2Params
+	BcryptCost int
+}
+
+// Argon2Params are the argon2id cost settings, stored in each hash so they can change over time
+type Argon2Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultHasherConfig follows the second recommended argon2id setting in RFC 9106
+func DefaultHasherConfig() HasherConfig {
+	return HasherConfig{
+		Algorithm: HashArgon2id,
+		Argon2: Argon2Params{
+			Memory:      64 * 1024,
+			Iterations:  3,
+			Parallelism: 4,
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+		BcryptCost: 12,
+	}
+}
+
+// passwordScheme is one hashing algorithm the hasher can produce or verify
+type passwordScheme interface {
+	fmt.Stringer
+	// recognises reports whether encoded was produced by this scheme
+	recognises(encoded string) bool
+	hash(password string) (string, error)
+	verify(encoded, password string) (bool, error)
+	// outdated reports whether encoded was made with other parameters than the scheme's current ones
+	outdated(encoded string) bool
+}
+
+// PasswordHasher hashes new passwords with the configured scheme and verifies hashes made by
+// any supported scheme, so the algorithm or its cost can change without resetting passwords
+type PasswordHasher struct {
+	current passwordScheme
+	schemes []passwordScheme
+}
+
+// NewPasswordHasher validates cfg and builds a hasher for it
+func NewPasswordHasher(cfg HasherConfig) (*PasswordHasher, error) {
+	argon := argon2idScheme{params: cfg.Argon2}
+	bc := bcryptScheme{cost: cfg.BcryptCost}
+
+	h := &PasswordHasher{schemes: []passwordScheme{argon, bc}}
+	switch cfg.Algorithm {
+	case "", HashArgon2id:
+		p := cfg.Argon2
+		if p.Memory < 8*uint32(p.Parallelism) || p.Iterations < 1 || p.Parallelism < 1 || p.SaltLength < 8 || p.KeyLength < 16 {
+			return nil, fmt.Errorf("invalid argon2id parameters: %+v", p)
+		}
+		h.current = argon
+	case HashBcrypt:
+		if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		h.current = bc
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q", cfg.Algorithm)
+	}
+	return h, nil
+}
+
+// Hash hashes password with the current scheme
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	encoded, err := h.current.hash(password)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return encoded, nil
+}
+
+// Verify checks password against encoded. When it matches, rehash reports whether encoded
+// should be replaced because it uses an older algorithm or parameters.
+func (h *PasswordHasher) Verify(encoded, password string) (ok, rehash bool, err error) {
+	for _, s := range h.schemes {
+		if !s.recognises(encoded) {
+			continue
+		}
+		ok, err := s.verify(encoded, password)
+		if err != nil || !ok {
+			return false, false, err
+		}
+		return true, s != h.current || s.outdated(encoded), nil
+	}
+	return false, false, ErrUnknownHash
+}
+
+// MaxPasswordLength is the longest password in bytes the current scheme uses in full
+func (h *PasswordHasher) MaxPasswordLength() int {
+	if _, ok := h.current.(bcryptScheme); ok {
+		return 72
+	}
+	return 256
+}
+
+// Benchmark times one hash with the current settings and logs it, warning when the cost is
+// too low to slow down guessing or high enough to make logins sluggish
+func (h *PasswordHasher) Benchmark() (time.Duration, error) {
+	start := time.Now()
+	if _, err := h.Hash("benchmark-password"); err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+
+	attrs := []any{slog.Duration("duration", elapsed), slog.String("scheme", h.current.String())}
+	switch {
+	case elapsed < 50*time.Millisecond:
+		slog.Warn("password hashing is fast; consider raising its cost", attrs...)
+	case elapsed > time.Second:
+		slog.Warn("password hashing is slow; logins will be sluggish", attrs...)
+	default:
+		slog.Info("password hashing benchmark", attrs...)
+	}
+	return elapsed, nil
+}
+
+// argon2idScheme produces PHC-format hashes: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+type argon2idScheme struct {
+	params Argon2Params
+}
+
+func (s argon2idScheme) String() string {
+	return fmt.Sprintf("argon2id m=%d,t=%d,p=%d", s.params.Memory, s.params.Iterations, s.params.Parallelism)
+}
+
+func (s argon2idScheme) recognises(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (s argon2idScheme) hash(password string) (string, error) {
+	salt := make([]byte, s.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, s.params.Iterations, s.params.Memory, s.params.Parallelism, s.params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, s.params.Memory, s.params.Iterations, s.params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (s argon2idScheme) verify(encoded, password string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return subtle.ConstantTimeCompare(candidate, key) == 1, nil
+}
+
+func (s argon2idScheme) outdated(encoded string) bool {
+	params, salt, _, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Memory != s.params.Memory ||
+		params.Iterations != s.params.Iterations ||
+		params.Parallelism != s.params.Parallelism ||
+		params.KeyLength != s.params.KeyLength ||
+		uint32(len(salt)) != s.params.SaltLength
+}
+
+// decodeArgon2id parses a PHC-format argon2id hash
+func decodeArgon2id(encoded string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != HashArgon2id {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 parameters %q: %w", parts[3], err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 key: %w", err)
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+// bcryptScheme produces standard $2a$ bcrypt hashes
+type bcryptScheme struct {
+	cost int
+}
+
+func (s bcryptScheme) String() string {
+	return fmt.Sprintf("bcrypt cost=%d", s.cost)
+}
+
+func (s bcryptScheme) recognises(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (s bcryptScheme) hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), s.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+func (s bcryptScheme) verify(encoded, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s bcryptScheme) outdated(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != s.cost
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2Params keeps the tests fast; production defaults are far more expensive
+var testArgon2Params = Argon2Params{
+	Memory:      64,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func newTestHasher(t *testing.T, cfg HasherConfig) *PasswordHasher {
+	t.Helper()
+	h, err := NewPasswordHasher(cfg)
+	if err != nil {
+		t.Fatalf("NewPasswordHasher(%+v): %v", cfg, err)
+	}
+	return h
+}
+
+func TestNewPasswordHasher(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     HasherConfig
+		wantErr bool
+	}{
+		{"defaults", DefaultHasherConfig(), false},
+		{"empty algorithm means argon2id", HasherConfig{Argon2: testArgon2Params}, false},
+		{"bcrypt", HasherConfig{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost}, false},
+		{"unknown algorithm", HasherConfig{Algorithm: "md5", Argon2: testArgon2Params}, true},
+		{"bcrypt cost too low", HasherConfig{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost - 1}, true},
+		{"bcrypt cost too high", HasherConfig{Algorithm: HashBcrypt, BcryptCost: bcrypt.MaxCost + 1}, true},
+		{"argon2 no iterations", HasherConfig{Argon2: Argon2Params{Memory: 64, Parallelism: 1, SaltLength: 16, KeyLength: 32}}, true},
+		{"argon2 no parallelism", HasherConfig{Argon2: Argon2Params{Memory: 64, Iterations: 1, SaltLength: 16, KeyLength: 32}}, true},
+		{"argon2 memory below 8 KiB per lane", HasherConfig{Argon2: Argon2Params{Memory: 31, Iterations: 1, Parallelism: 4, SaltLength: 16, KeyLength: 32}}, true},
+		{"argon2 short salt", HasherConfig{Argon2: Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 4, KeyLength: 32}}, true},
+		{"argon2 short key", HasherConfig{Argon2: Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 8}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPasswordHasher(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestArgon2idEncoding(t *testing.T) {
+	h := newTestHasher(t, HasherConfig{Algorithm: HashArgon2id, Argon2: testArgon2Params})
+
+	encoded, err := h.Hash("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("hash %q is not in PHC format", encoded)
+	}
+
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		t.Fatalf("decodeArgon2id: %v", err)
+	}
+	if params != testArgon2Params {
+		t.Errorf("decoded params = %+v, want %+v", params, testArgon2Params)
+	}
+	if len(salt) != 16 || len(key) != 32 {
+		t.Errorf("salt and key lengths = %d, %d, want 16, 32", len(salt), len(key))
+	}
+
+	again, err := h.Hash("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == encoded {
+		t.Error("two hashes of the same password share a salt")
+	}
+}
+
+func TestDecodeArgon2idRejectsMalformedHashes(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"empty", ""},
+		{"too few parts", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA"},
+		{"too many parts", "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$a2V5$extra"},
+		{"argon2i", "$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5"},
+		{"old version", "$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5"},
+		{"bad parameters", "$argon2id$v=19$m=x,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5"},
+		{"bad salt", "$argon2id$v=19$m=64,t=1,p=1$!!!$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5"},
+		{"bad key", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$!!!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, _, err := decodeArgon2id(tt.encoded); err == nil {
+				t.Errorf("decodeArgon2id(%q) succeeded", tt.encoded)
+			}
+		})
+	}
+}
+
+func TestPasswordHasherVerify(t *testing.T) {
+	const password = "correct horse battery staple"
+
+	current := HasherConfig{Algorithm: HashArgon2id, Argon2: testArgon2Params}
+	stronger := current
+	stronger.Argon2.Iterations = 2
+	longerKey := current
+	longerKey.Argon2.KeyLength = 64
+	bcryptCfg := HasherConfig{Algorithm: HashBcrypt, Argon2: testArgon2Params, BcryptCost: bcrypt.MinCost}
+	bcryptCostlier := bcryptCfg
+	bcryptCostlier.BcryptCost = bcrypt.MinCost + 1
+
+	tests := []struct {
+		name       string
+		hashWith   HasherConfig
+		verifyWith HasherConfig
+		password   string
+		wantOK     bool
+		wantRehash bool
+	}{
+		{"argon2id match", current, current, password, true, false},
+		{"argon2id mismatch", current, current, "wrong password", false, false},
+		{"argon2id older iterations", current, stronger, password, true, true},
+		{"argon2id older key length", current, longerKey, password, true, true},
+		{"argon2id newer parameters still verify", stronger, current, password, true, true},
+		{"argon2id mismatch is never rehashed", current, stronger, "wrong password", false, false},
+		{"bcrypt upgraded to argon2id", bcryptCfg, current, password, true, true},
+		{"bcrypt mismatch", bcryptCfg, current, "wrong password", false, false},
+		{"bcrypt match", bcryptCfg, bcryptCfg, password, true, false},
+		{"bcrypt older cost", bcryptCfg, bcryptCostlier, password, true, true},
+		{"argon2id downgraded to bcrypt", current, bcryptCfg, password, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := newTestHasher(t, tt.hashWith).Hash(password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, rehash, err := newTestHasher(t, tt.verifyWith).Verify(encoded, tt.password)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if ok != tt.wantOK || rehash != tt.wantRehash {
+				t.Errorf("Verify = (%v, %v), want (%v, %v)", ok, rehash, tt.wantOK, tt.wantRehash)
+			}
+		})
+	}
+}
+
+func TestPasswordHasherVerifyUnknownHash(t *testing.T) {
+	h := newTestHasher(t, HasherConfig{Algorithm: HashArgon2id, Argon2: testArgon2Params})
+	for _, encoded := range []string{"", "plaintext", "$1$md5crypt$hash", "$scrypt$ln=15,r=8,p=1$c2FsdA$a2V5"} {
+		ok, rehash, err := h.Verify(encoded, "password")
+		if !errors.Is(err, ErrUnknownHash) || ok || rehash {
+			t.Errorf("Verify(%q) = (%v, %v, %v), want ErrUnknownHash", encoded, ok, rehash, err)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// Impersonation errors
+var (
+	ErrImpersonateSelf      = errors.New("you cannot impersonate yourself")
+	ErrImpersonationDenied  = errors.New("users who can impersonate others cannot be impersonated")
+	ErrAlreadyImpersonating = errors.New("stop impersonating the current user first")
+	ErrNotImpersonating     = errors.New("not impersonating anyone")
+	ErrImpersonating        = errors.New("this action is not available while impersonating a user")
+)
+
+const impersonatorContextKey = "impersonator"
+
+// CheckImpersonation returns the user adminID may sign in as. Other impersonators cannot be
+// impersonated, so nobody can borrow more access than they already have.
+func (a *AuthService) CheckImpersonation(ctx context.Context, adminID, userID int32) (*database.User, error) {
+	if adminID == userID {
+		return nil, ErrImpersonateSelf
+	}
+	user, err := a.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !database.PgBoolToBool(user.IsActive) {
+		return nil, ErrUserInactive
+	}
+
+	access, err := a.UserAccess(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if access.Can(PermUsersImpersonate) {
+		return nil, ErrImpersonationDenied
+	}
+	return user, nil
+}
+
+// impersonator loads the admin behind an impersonated session, who must still be allowed to
+// impersonate for the session to carry on
+func (a *AuthService) impersonator(ctx context.Context, adminID int32) (*database.User, error) {
+	admin, err := a.CurrentUser(ctx, adminID)
+	if err != nil {
+		return nil, err
+	}
+	access, err := a.UserAccess(ctx, adminID)
+	if err != nil {
+		return nil, err
+	}
+	if !access.Can(PermUsersImpersonate) {
+		return nil, ErrImpersonationDenied
+	}
+	return admin, nil
+}
+
+// impersonatorID returns the admin behind an impersonated session
+func impersonatorID(sess *sessions.Session) (int32, bool) {
+	adminID, ok := sess.Values[ImpersonatorIDKey].(int32)
+	return adminID, ok
+}
+
+// GetImpersonator returns the admin signed in as the current user, or nil when the user is
+// signed in as themselves
+func GetImpersonator(c echo.Context) *database.User {
+	admin, _ := c.Get(impersonatorContextKey).(*database.User)
+	return admin
+}
+
+// setSessionUser makes user the effective user of the session
+func setSessionUser(sess *sessions.Session, user *database.User) {
+	sess.Values[UserIDKey] = user.ID
+	sess.Values[UsernameKey] = user.Username
+	sess.Values[IsVerifiedKey] = database.PgBoolToBool(user.IsVerified)
+}
+
+// NotWhileImpersonatingMiddleware refuses actions an admin must not take on someone else's
+// behalf, such as changing their sign-in methods. It must run after AuthMiddleware.
+func NotWhileImpersonatingMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if GetImpersonator(c) != nil {
+				if wantsJSONError(c) {
+					return c.JSON(http.StatusForbidden, map[string]string{
+						"error": ErrImpersonating.Error(),
+					})
+				}
+				return c.String(http.StatusForbidden, "This page is not available while you are impersonating a user.")
+			}
+			return next(c)
+		}
+	}
+}
+
+// impersonationBanner is shown above every page of an impersonated session
+func impersonationBanner(c echo.Context, admin, user *database.User) string {
+	return fmt.Sprintf(`
+		<div role="alert" style="position:sticky;top:0;z-index:1000;padding:.5em 1em;background:#b45309;color:#fff">
+			Viewing as <strong>%s</strong>. You are signed in as %s.
+			<form method="POST" action="/impersonation/stop" style="display:inline">
+				%s
+				<button type="submit">Stop impersonating</button>
+			</form>
+		</div>
+	`, html.EscapeString(user.Username), html.EscapeString(admin.Username), csrfField(c))
+}
+
+// showImpersonationBanner marks every page of the response as seen through someone else's account
+func showImpersonationBanner(c echo.Context, admin, user *database.User) {
+	res := c.Response()
+	res.Writer = &bannerWriter{ResponseWriter: res.Writer, banner: impersonationBanner(c, admin, user)}
+}
+
+// bannerWriter puts a banner in front of HTML responses
+type bannerWriter struct {
+	http.ResponseWriter
+	banner  string
+	started bool
+}
+
+func (w *bannerWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		if strings.HasPrefix(w.Header().Get(echo.HeaderContentType), echo.MIMETextHTML) {
+			if _, err := io.WriteString(w.ResponseWriter, w.banner); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bannerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Sign in as another user (POST). The login stays recorded under the admin's own
+// user_sessions row, so it is revoked with the admin's sessions and never appears in, or can
+// be revoked from, the impersonated user's session list.
+func (h *AuthHandlers) StartImpersonation(c echo.Context) error {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load session",
+		})
+	}
+	if _, ok := impersonatorID(sess); ok {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": ErrAlreadyImpersonating.Error(),
+		})
+	}
+
+	ctx := c.Request().Context()
+	adminID := c.Get("user_id").(int32)
+	user, err := h.authService.CheckImpersonation(ctx, adminID, userID)
+	if err != nil {
+		return impersonationError(c, err)
+	}
+
+	// Acting as someone else is a privilege change like any login
+	if err := regenerateSession(c, sess); err != nil {
+		return impersonationError(c, err)
+	}
+	sess.Values[ImpersonatorIDKey] = adminID
+	setSessionUser(sess, user)
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return impersonationError(c, fmt.Errorf("failed to save session: %w", err))
+	}
+
+	h.authService.recordSecurityEvent(ctx, EventImpersonationStarted,
+		slog.Any("user_id", user.ID),
+		slog.Any("actor_id", adminID),
+	)
+
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, map[string]string{
+			"message":  "Impersonating " + user.Username,
+			"redirect": defaultLoginRedirect,
+		})
+	}
+	return c.Redirect(http.StatusFound, defaultLoginRedirect)
+}
+
+// Return to the admin's own account (POST)
+func (h *AuthHandlers) StopImpersonation(c echo.Context) error {
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load session",
+		})
+	}
+	admin := GetImpersonator(c)
+	if admin == nil {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": ErrNotImpersonating.Error(),
+		})
+	}
+	userID := c.Get("user_id").(int32)
+
+	if err := regenerateSession(c, sess); err != nil {
+		return impersonationError(c, err)
+	}
+	delete(sess.Values, ImpersonatorIDKey)
+	setSessionUser(sess, admin)
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return impersonationError(c, fmt.Errorf("failed to save session: %w", err))
+	}
+
+	h.authService.recordSecurityEvent(c.Request().Context(), EventImpersonationEnded,
+		slog.Any("user_id", userID),
+		slog.Any("actor_id", admin.ID),
+		slog.String("reason", "stopped"),
+	)
+
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, map[string]string{
+			"message":  "Stopped impersonating",
+			"redirect": "/admin/users",
+		})
+	}
+	return c.Redirect(http.StatusFound, "/admin/users")
+}
+
+func impersonationError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, ErrImpersonateSelf), errors.Is(err, ErrImpersonationDenied):
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": err.Error(),
+		})
+	case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrUserInactive):
+		return adminUserError(c, err)
+	default:
+		slog.Error("impersonation failed", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to switch user",
+		})
+	}
+}
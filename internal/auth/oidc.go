@@ -0,0 +1,644 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/oauth2"
+)
+
+// Single sign-on errors
+var (
+	ErrUnknownProvider     = errors.New("unknown sign-in provider")
+	ErrOIDCFlow            = errors.New("sign-in could not be completed, please try again")
+	ErrNoLinkedAccount     = errors.New("no account is linked to this sign-in and sign-up is disabled")
+	ErrDomainNotAllowed    = errors.New("accounts from this email domain may not sign in")
+	ErrIdentityLinked      = errors.New("this sign-in is already linked to another account")
+	ErrIdentityNotFound    = errors.New("linked sign-in not found")
+	ErrUnverifiedOIDCEmail = errors.New("the provider has not verified this email address")
+	ErrLinkRequired        = errors.New("an account with this email already exists; sign in and link this provider from your settings")
+)
+
+const (
+	// Separate, short-lived cookie session holding state for an in-flight sign-in. It uses
+	// SameSite=Lax because the provider redirects back cross-site.
+	oidcSessionName = "oidc-flow"
+	oidcFlowKey     = "flow"
+	oidcFlowTTL     = 10 * time.Minute
+)
+
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9-]{1,50}$`)
+
+// OIDCProviderConfig describes one OpenID Connect identity provider
+type OIDCProviderConfig struct {
+	Name           string // used in URLs and stored with linked identities, e.g. "google"
+	DisplayName    string // shown on the login page
+	IssuerURL      string // discovery document is fetched from <IssuerURL>/.well-known/openid-configuration
+	ClientID       string
+	ClientSecret   string
+	Scopes         []string // requested in addition to "openid"
+	AllowSignup    bool     // create an account on first sign-in (just-in-time provisioning)
+	AllowedDomains []string // when set, only email addresses in these domains may sign in
+	TrustEmail     bool     // link the first sign-in to an existing account with the same verified email
+}
+
+type oidcProvider struct {
+	cfg         OIDCProviderConfig
+	redirectURL string
+
+	mu       sync.Mutex
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// OIDCService signs users in through external OpenID Connect providers
+type OIDCService struct {
+	db          *database.Queries
+	authService *AuthService
+	providers   map[string]*oidcProvider
+	order       []string
+}
+
+// oidcFlow is the state kept between redirecting to the provider and its callback
+type oidcFlow struct {
+	Provider   string    `json:"provider"`
+	State      string    `json:"state"`
+	Nonce      string    `json:"nonce"`
+	Verifier   string    `json:"verifier"`
+	LinkUserID int32     `json:"link_user_id,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+}
+
+// oidcClaims are the ID token claims used to find or create the local account
+type oidcClaims struct {
+	Email             string `json:"email"`
+	EmailVerified     *bool  `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	GivenName         string `json:"given_name"`
+	FamilyName        string `json:"family_name"`
+	HostedDomain      string `json:"hd"`
+}
+
+// NewOIDCService validates the provider configuration. Discovery happens on first use,
+// so an unreachable provider does not stop the server from starting.
+func NewOIDCService(db *database.Queries, authService *AuthService, baseURL string, configs []OIDCProviderConfig) (*OIDCService, error) {
+	s := &OIDCService{db: db, authService: authService, providers: map[string]*oidcProvider{}}
+	for _, cfg := range configs {
+		if !providerNamePattern.MatchString(cfg.Name) {
+			return nil, fmt.Errorf("invalid OIDC provider name %q", cfg.Name)
+		}
+		if cfg.IssuerURL == "" || cfg.ClientID == "" {
+			return nil, fmt.Errorf("OIDC provider %q needs an issuer URL and client ID", cfg.Name)
+		}
+		if _, exists := s.providers[cfg.Name]; exists {
+			return nil, fmt.Errorf("duplicate OIDC provider %q", cfg.Name)
+		}
+		if cfg.DisplayName == "" {
+			cfg.DisplayName = cfg.Name
+		}
+		s.providers[cfg.Name] = &oidcProvider{
+			cfg:         cfg,
+			redirectURL: fmt.Sprintf("%s/auth/oidc/%s/callback", strings.TrimRight(baseURL, "/"), cfg.Name),
+		}
+		s.order = append(s.order, cfg.Name)
+	}
+	return s, nil
+}
+
+// Providers returns the configured providers in configuration order
+func (s *OIDCService) Providers() []OIDCProviderConfig {
+	out := make([]OIDCProviderConfig, 0, len(s.order))
+	for _, name := range s.order {
+		out = append(out, s.providers[name].cfg)
+	}
+	return out
+}
+
+// provider returns the named provider, fetching its discovery document the first time
+func (s *OIDCService) provider(ctx context.Context, name string) (*oidcProvider, error) {
+	p, ok := s.providers[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.verifier == nil {
+		provider, err := oidc.NewProvider(ctx, p.cfg.IssuerURL)
+		if err != nil {
+			return nil, fmt.Errorf("OIDC discovery for %s failed: %w", name, err)
+		}
+		p.verifier = provider.Verifier(&oidc.Config{ClientID: p.cfg.ClientID})
+		p.oauth2 = &oauth2.Config{
+			ClientID:     p.cfg.ClientID,
+			ClientSecret: p.cfg.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  p.redirectURL,
+			Scopes:       append([]string{oidc.ScopeOpenID}, p.cfg.Scopes...),
+		}
+	}
+	return p, nil
+}
+
+// AuthCodeURL starts a sign-in, returning the flow state to keep and the provider URL to redirect to
+func (s *OIDCService) AuthCodeURL(ctx context.Context, name string, linkUserID int32) (*oidcFlow, string, error) {
+	p, err := s.provider(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	state, err := randomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	nonce, err := randomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	flow := &oidcFlow{
+		Provider:   name,
+		State:      state,
+		Nonce:      nonce,
+		Verifier:   oauth2.GenerateVerifier(),
+		LinkUserID: linkUserID,
+		StartedAt:  time.Now(),
+	}
+
+	opts := []oauth2.AuthCodeOption{oidc.Nonce(nonce), oauth2.S256ChallengeOption(flow.Verifier)}
+	if len(p.cfg.AllowedDomains) == 1 {
+		// Google Workspace shows only accounts from this domain
+		opts = append(opts, oauth2.SetAuthURLParam("hd", p.cfg.AllowedDomains[0]))
+	}
+	return flow, p.oauth2.AuthCodeURL(state, opts...), nil
+}
+
+// Exchange checks the callback against flow, redeems the code and verifies the ID token's
+// signature, audience, expiry and nonce
+func (s *OIDCService) Exchange(ctx context.Context, flow *oidcFlow, name, state, code string) (*oidc.IDToken, *oidcClaims, error) {
+	if flow == nil || flow.Provider != name || time.Since(flow.StartedAt) > oidcFlowTTL ||
+		subtle.ConstantTimeCompare([]byte(flow.State), []byte(state)) != 1 {
+		return nil, nil, ErrOIDCFlow
+	}
+
+	p, err := s.provider(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(flow.Verifier))
+	if err != nil {
+		return nil, nil, fmt.Errorf("code exchange failed: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, nil, errors.New("token response has no id_token")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(flow.Nonce)) != 1 {
+		return nil, nil, ErrOIDCFlow
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse ID token claims: %w", err)
+	}
+	if err := checkAllowedDomain(p.cfg, &claims); err != nil {
+		return nil, nil, err
+	}
+	return idToken, &claims, nil
+}
+
+func checkAllowedDomain(cfg OIDCProviderConfig, claims *oidcClaims) error {
+	if len(cfg.AllowedDomains) == 0 {
+		return nil
+	}
+	if claims.EmailVerified == nil || !*claims.EmailVerified {
+		return ErrUnverifiedOIDCEmail
+	}
+	_, domain, _ := strings.Cut(claims.Email, "@")
+	for _, allowed := range cfg.AllowedDomains {
+		if strings.EqualFold(domain, allowed) && (claims.HostedDomain == "" || strings.EqualFold(claims.HostedDomain, allowed)) {
+			return nil
+		}
+	}
+	return ErrDomainNotAllowed
+}
+
+// ResolveUser finds the account for a verified ID token. Identities already linked win; otherwise
+// an active account with the same provider-verified email is linked if the provider is trusted
+// to vouch for email addresses, and failing that a new account is created when the provider
+// allows sign-up. An untrusted provider never takes over an existing account: its owner has to
+// sign in locally and link it from their settings.
+func (s *OIDCService) ResolveUser(ctx context.Context, name string, idToken *oidc.IDToken, claims *oidcClaims) (*database.User, error) {
+	emailVerified := claims.EmailVerified != nil && *claims.EmailVerified
+	email := database.StringToPgText(claims.Email)
+
+	identity, err := s.db.GetUserIdentity(ctx, database.GetUserIdentityParams{
+		Provider: name,
+		Subject:  idToken.Subject,
+	})
+	if err == nil {
+		user, err := s.db.GetUserByID(ctx, identity.UserID)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, ErrInvalidCredentials
+			}
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+		if err := s.db.TouchUserIdentity(ctx, database.TouchUserIdentityParams{ID: identity.ID, Email: email}); err != nil {
+			slog.Error("failed to record identity login", slog.Any("error", err))
+		}
+		return &user, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	var user database.User
+	if emailVerified && claims.Email != "" {
+		user, err = s.db.GetUserByEmail(ctx, claims.Email)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+	}
+	if user.ID != 0 && !s.providers[name].cfg.TrustEmail {
+		return nil, ErrLinkRequired
+	}
+	if user.ID == 0 {
+		if !s.providers[name].cfg.AllowSignup {
+			return nil, ErrNoLinkedAccount
+		}
+		if !emailVerified {
+			return nil, ErrUnverifiedOIDCEmail
+		}
+		created, err := s.provisionUser(ctx, claims)
+		if err != nil {
+			return nil, err
+		}
+		user = *created
+	}
+
+	if err := s.linkIdentity(ctx, user.ID, name, idToken.Subject, email); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// LinkIdentity attaches a provider identity to an existing, signed in user
+func (s *OIDCService) LinkIdentity(ctx context.Context, userID int32, name string, idToken *oidc.IDToken, claims *oidcClaims) error {
+	existing, err := s.db.GetUserIdentity(ctx, database.GetUserIdentityParams{
+		Provider: name,
+		Subject:  idToken.Subject,
+	})
+	if err == nil {
+		if existing.UserID != userID {
+			return ErrIdentityLinked
+		}
+		return nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return s.linkIdentity(ctx, userID, name, idToken.Subject, database.StringToPgText(claims.Email))
+}
+
+func (s *OIDCService) linkIdentity(ctx context.Context, userID int32, name, subject string, email pgtype.Text) error {
+	if _, err := s.db.CreateUserIdentity(ctx, database.CreateUserIdentityParams{
+		UserID:   userID,
+		Provider: name,
+		Subject:  subject,
+		Email:    email,
+	}); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrIdentityLinked
+		}
+		return fmt.Errorf("failed to link identity: %w", err)
+	}
+	return nil
+}
+
+// provisionUser creates a verified account from ID token claims. The password is random and
+// never shown; the user can set one later through the password reset flow.
+func (s *OIDCService) provisionUser(ctx context.Context, claims *oidcClaims) (*database.User, error) {
+	password, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	hashedPassword, err := s.authService.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	base := usernameFromClaims(claims)
+	for attempt := 0; attempt < 5; attempt++ {
+		username := base
+		if attempt > 0 {
+			suffix, err := randomToken(3)
+			if err != nil {
+				return nil, err
+			}
+			username = fmt.Sprintf("%s-%s", base[:min(len(base), 45)], strings.ToLower(suffix))
+		}
+
+		created, err := s.db.CreateUser(ctx, database.CreateUserParams{
+			Username:     username,
+			Email:        claims.Email,
+			PasswordHash: hashedPassword,
+			FirstName:    database.StringToPgText(claims.GivenName),
+			LastName:     database.StringToPgText(claims.FamilyName),
+		})
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == "23505" && strings.Contains(pgErr.ConstraintName, "username") {
+				continue
+			}
+			if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+				return nil, ErrUserExists
+			}
+			return nil, fmt.Errorf("failed to create user: %w", err)
+		}
+
+		if err := s.db.VerifyUser(ctx, created.ID); err != nil {
+			return nil, fmt.Errorf("failed to verify user: %w", err)
+		}
+		if err := s.authService.AssignRole(ctx, created.ID, DefaultRole); err != nil {
+			slog.Error("failed to assign default role", slog.Any("user_id", created.ID), slog.Any("error", err))
+		}
+
+		user, err := s.db.GetUserByID(ctx, created.ID)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+		return &user, nil
+	}
+	return nil, ErrUserExists
+}
+
+var usernameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// usernameFromClaims suggests a username that satisfies usernamePattern
+func usernameFromClaims(claims *oidcClaims) string {
+	candidate := claims.PreferredUsername
+	if candidate == "" || strings.Contains(candidate, "@") {
+		candidate, _, _ = strings.Cut(claims.Email, "@")
+	}
+	candidate = usernameInvalidChars.ReplaceAllString(NormalizeUsername(candidate), "")
+	if len(candidate) > 50 {
+		candidate = candidate[:50]
+	}
+	for len(candidate) < 3 {
+		candidate += "_"
+	}
+	return candidate
+}
+
+// saveOIDCFlow stores flow in the short-lived sign-in cookie session
+func saveOIDCFlow(c echo.Context, cookies SessionConfig, flow *oidcFlow) error {
+	sess, err := session.Get(oidcSessionName, c)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(flow)
+	if err != nil {
+		return err
+	}
+	sess.Values[oidcFlowKey] = string(data)
+	sess.Options = cookies.CookieOptions("/auth/oidc/", oidcFlowTTL)
+	// Must be sent on the provider's cross-site redirect back to the callback
+	sess.Options.SameSite = http.SameSiteLaxMode
+	return sess.Save(c.Request(), c.Response())
+}
+
+// takeOIDCFlow returns the stored flow and deletes it, so each callback can only be used once
+func takeOIDCFlow(c echo.Context, cookies SessionConfig) *oidcFlow {
+	sess, err := session.Get(oidcSessionName, c)
+	if err != nil {
+		return nil
+	}
+	data, _ := sess.Values[oidcFlowKey].(string)
+	sess.Options = cookies.CookieOptions("/auth/oidc/", 0)
+	sess.Options.MaxAge = -1
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		slog.Error("failed to clear sign-in state", slog.Any("error", err))
+	}
+
+	var flow oidcFlow
+	if data == "" || json.Unmarshal([]byte(data), &flow) != nil {
+		return nil
+	}
+	return &flow
+}
+
+// continueTo sends the browser on with a same-site navigation. After a cross-site redirect from
+// the provider a plain 302 would not carry the SameSite=Strict login cookie.
+func continueTo(c echo.Context, path string) error {
+	escaped := html.EscapeString(path)
+	return c.HTML(http.StatusOK, fmt.Sprintf(`
+		<meta http-equiv="refresh" content="0;url=%s">
+		<p>Signing you in… <a href="%s">Continue</a></p>
+	`, escaped, escaped))
+}
+
+// oidcLoginLinks renders a sign-in link per provider for the login page
+func (h *AuthHandlers) oidcLoginLinks() string {
+	if h.oidc == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, p := range h.oidc.Providers() {
+		fmt.Fprintf(&b, `<p><a href="/auth/oidc/%s">Sign in with %s</a></p>`, p.Name, html.EscapeString(p.DisplayName))
+	}
+	return b.String()
+}
+
+// Start signing in (GET). Runs behind GuestOnlyMiddleware, so a signed in user is never
+// signed in again over the top of their login.
+func (h *AuthHandlers) BeginOIDCLogin(c echo.Context) error {
+	return h.beginOIDCFlow(c, 0)
+}
+
+// Start linking an identity to the signed in account (GET). Runs behind AuthMiddleware, which
+// has confirmed the login server-side, and never while impersonating, since a linked identity
+// would give the admin a way back into someone else's account.
+func (h *AuthHandlers) BeginOIDCLink(c echo.Context) error {
+	return h.beginOIDCFlow(c, c.Get("user_id").(int32))
+}
+
+// beginOIDCFlow sends the browser to the provider, linking the identity it returns to
+// linkUserID, or signing in with it when linkUserID is 0
+func (h *AuthHandlers) beginOIDCFlow(c echo.Context, linkUserID int32) error {
+	flow, url, err := h.oidc.AuthCodeURL(c.Request().Context(), c.Param("provider"), linkUserID)
+	if err != nil {
+		if errors.Is(err, ErrUnknownProvider) {
+			return c.String(http.StatusNotFound, ErrUnknownProvider.Error())
+		}
+		slog.Error("failed to start OIDC sign-in", slog.Any("error", err))
+		return c.String(http.StatusBadGateway, "The sign-in provider is unavailable, please try again later.")
+	}
+
+	if err := saveOIDCFlow(c, h.authService.sessions, flow); err != nil {
+		slog.Error("failed to save sign-in state", slog.Any("error", err))
+		return c.String(http.StatusInternalServerError, "Failed to start sign-in")
+	}
+	return c.Redirect(http.StatusFound, url)
+}
+
+// Provider redirects back here after sign-in (GET)
+func (h *AuthHandlers) OIDCCallback(c echo.Context) error {
+	ctx := c.Request().Context()
+	name := c.Param("provider")
+	flow := takeOIDCFlow(c, h.authService.sessions)
+
+	if providerErr := c.QueryParam("error"); providerErr != "" {
+		slog.Info("OIDC provider returned an error", slog.String("provider", name), slog.String("error", providerErr))
+		return c.String(http.StatusUnauthorized, "Sign-in was cancelled or refused by the provider.")
+	}
+
+	idToken, claims, err := h.oidc.Exchange(ctx, flow, name, c.QueryParam("state"), c.QueryParam("code"))
+	if err != nil {
+		return oidcError(c, err)
+	}
+
+	if flow.LinkUserID != 0 {
+		if err := h.oidc.LinkIdentity(ctx, flow.LinkUserID, name, idToken, claims); err != nil {
+			return oidcError(c, err)
+		}
+		return continueTo(c, "/settings/identities")
+	}
+
+	user, err := h.oidc.ResolveUser(ctx, name, idToken, claims)
+	if err != nil {
+		return oidcError(c, err)
+	}
+
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "Session error")
+	}
+
+	// A linked identity stands in for the password, not for the second factor
+	twoFactor, err := h.authService.TwoFactorEnabled(ctx, user.ID)
+	if err != nil {
+		slog.Error("failed to check two-factor status", slog.Any("error", err))
+		return c.String(http.StatusInternalServerError, "Login failed")
+	}
+	if twoFactor {
+		markPendingTwoFactor(sess, user.ID)
+		err := regenerateSession(c, sess)
+		if err == nil {
+			err = sess.Save(c.Request(), c.Response())
+		}
+		if err != nil {
+			slog.Error("failed to save session", slog.Any("error", err))
+			return c.String(http.StatusInternalServerError, "Failed to save session")
+		}
+		return continueTo(c, "/login/2fa")
+	}
+
+	redirect := takeReturnTo(sess)
+	if err := h.startSession(c, sess, user, "oidc:"+name); err != nil {
+		slog.Error("failed to start session", slog.Any("error", err))
+		return c.String(http.StatusInternalServerError, "Failed to create session")
+	}
+	return continueTo(c, redirect)
+}
+
+func oidcError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, ErrUnknownProvider):
+		return c.String(http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrOIDCFlow), errors.Is(err, ErrNoLinkedAccount), errors.Is(err, ErrDomainNotAllowed),
+		errors.Is(err, ErrUnverifiedOIDCEmail), errors.Is(err, ErrInvalidCredentials):
+		return c.String(http.StatusUnauthorized, err.Error())
+	case errors.Is(err, ErrIdentityLinked), errors.Is(err, ErrUserExists), errors.Is(err, ErrLinkRequired):
+		return c.String(http.StatusConflict, err.Error())
+	default:
+		slog.Error("OIDC sign-in failed", slog.Any("error", err))
+		return c.String(http.StatusUnauthorized, "Sign-in failed")
+	}
+}
+
+// Linked sign-in identities page (GET)
+func (h *AuthHandlers) ShowIdentities(c echo.Context) error {
+	identities, err := h.authService.db.ListUserIdentities(c.Request().Context(), c.Get("user_id").(int32))
+	if err != nil {
+		slog.Error("failed to list identities", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load linked sign-ins",
+		})
+	}
+
+	linked := map[string]bool{}
+	var b strings.Builder
+	b.WriteString("<h1>Linked sign-ins</h1><ul>")
+	for _, identity := range identities {
+		linked[identity.Provider] = true
+		fmt.Fprintf(&b, `
+			<li>%s (%s)
+				<form method="POST" action="/settings/identities/%d/unlink" style="display:inline">
+					%s
+					<button type="submit">Unlink</button>
+				</form>
+			</li>`, html.EscapeString(identity.Provider), html.EscapeString(database.PgTextToString(identity.Email)), identity.ID, csrfField(c))
+	}
+	b.WriteString("</ul>")
+	for _, p := range h.oidc.Providers() {
+		if !linked[p.Name] {
+			fmt.Fprintf(&b, `<p><a href="/settings/identities/link/%s">Link %s</a></p>`, p.Name, html.EscapeString(p.DisplayName))
+		}
+	}
+	return c.HTML(http.StatusOK, b.String())
+}
+
+// Unlink a sign-in identity (POST)
+func (h *AuthHandlers) UnlinkIdentity(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid identity ID",
+		})
+	}
+
+	n, err := h.authService.db.DeleteUserIdentity(c.Request().Context(), database.DeleteUserIdentityParams{
+		ID:     int32(id),
+		UserID: c.Get("user_id").(int32),
+	})
+	if err != nil {
+		slog.Error("failed to unlink identity", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to unlink sign-in",
+		})
+	}
+	if n == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": ErrIdentityNotFound.Error(),
+		})
+	}
+
+	if wantsJSON(c) {
+		return c.NoContent(http.StatusNoContent)
+	}
+	return c.Redirect(http.StatusFound, "/settings/identities")
+}
@@ -0,0 +1,659 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// Passkey errors
+var (
+	ErrPasskeyNotFound = errors.New("passkey not found")
+	ErrPasskeyExists   = errors.New("passkey is already registered")
+	ErrPasskeyCloned   = errors.New("passkey signature counter went backwards")
+)
+
+// How long a browser has to complete a passkey ceremony
+const passkeyCeremonyTimeout = 5 * time.Minute
+
+// Longest passkey label, in characters
+const maxPasskeyNameLength = 100
+
+// RelyingPartyConfig identifies this site to authenticators
+type RelyingPartyConfig struct {
+	ID          string   // registrable domain, e.g. "farm.example.com" or "localhost"
+	DisplayName string   // shown by the browser during ceremonies
+	Origins     []string // full origins allowed to run ceremonies, e.g. "https://farm.example.com"
+}
+
+// PasskeyService runs WebAuthn registration and login ceremonies
+type PasskeyService struct {
+	db        *database.Queries
+	rp        *webauthn.WebAuthn
+	handleKey []byte
+}
+
+// NewPasskeyService builds the service for a relying party. handleKey derives the opaque
+// user handles given to authenticators and must stay stable across restarts.
+func NewPasskeyService(db *database.Queries, cfg RelyingPartyConfig, handleKey []byte) (*PasskeyService, error) {
+	rp, err := webauthn.New(&webauthn.Config{
+		RPID:          cfg.ID,
+		RPDisplayName: cfg.DisplayName,
+		RPOrigins:     cfg.Origins,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: passkeyCeremonyTimeout, TimeoutUVD: passkeyCeremonyTimeout},
+			Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: passkeyCeremonyTimeout, TimeoutUVD: passkeyCeremonyTimeout},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid relying party config: %w", err)
+	}
+	return &PasskeyService{db: db, rp: rp, handleKey: handleKey}, nil
+}
+
+// passkeyUser adapts a database user to webauthn.User
+type passkeyUser struct {
+	user        database.User
+	handle      []byte
+	credentials []webauthn.Credential
+}
+
+func (u *passkeyUser) WebAuthnID() []byte                         { return u.handle }
+func (u *passkeyUser) WebAuthnName() string                       { return u.user.Username }
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	if name := database.PgTextToString(u.user.FirstName); name != "" {
+		return name
+	}
+	return u.user.Username
+}
+
+// userHandle derives the user handle so the numeric user ID is never given to authenticators
+func (s *PasskeyService) userHandle(userID int32) []byte {
+	var id [4]byte
+	binary.BigEndian.PutUint32(id[:], uint32(userID))
+
+	h := hmac.New(sha256.New, s.handleKey)
+	h.Write([]byte("webauthn-user-handle:"))
+	h.Write(id[:])
+	return h.Sum(nil)
+}
+
+func (s *PasskeyService) loadUser(ctx context.Context, user database.User) (*passkeyUser, error) {
+	rows, err := s.db.ListWebAuthnCredentialsByUser(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load passkeys: %w", err)
+	}
+
+	credentials := make([]webauthn.Credential, 0, len(rows))
+	for _, row := range rows {
+		credentials = append(credentials, toWebAuthnCredential(row))
+	}
+
+	return &passkeyUser{
+		user:        user,
+		handle:      s.userHandle(user.ID),
+		credentials: credentials,
+	}, nil
+}
+
+func toWebAuthnCredential(row database.WebauthnCredential) webauthn.Credential {
+	transports := make([]protocol.AuthenticatorTransport, 0, len(row.Transports))
+	for _, t := range row.Transports {
+		transports = append(transports, protocol.AuthenticatorTransport(t))
+	}
+
+	return webauthn.Credential{
+		ID:              row.CredentialID,
+		PublicKey:       row.PublicKey,
+		AttestationType: row.AttestationType,
+		Transport:       transports,
+		Flags: webauthn.CredentialFlags{
+			BackupEligible: row.BackupEligible,
+			BackupState:    row.BackupState,
+		},
+		Authenticator: webauthn.Authenticator{
+			AAGUID:    row.Aaguid,
+			SignCount: uint32(row.SignCount),
+		},
+	}
+}
+
+// BeginRegistration starts a ceremony to add a discoverable passkey for user
+func (s *PasskeyService) BeginRegistration(ctx context.Context, user database.User) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
+	pu, err := s.loadUser(ctx, user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s.rp.BeginRegistration(pu,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(webauthn.Credentials(pu.credentials).CredentialDescriptors()),
+	)
+}
+
+// FinishRegistration verifies the authenticator response and stores the new passkey
+func (s *PasskeyService) FinishRegistration(ctx context.Context, user database.User, sessionData webauthn.SessionData, name string, response *protocol.ParsedCredentialCreationData) (*database.WebauthnCredential, error) {
+	pu, err := s.loadUser(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := s.rp.CreateCredential(pu, sessionData, response)
+	if err != nil {
+		return nil, fmt.Errorf("passkey registration failed: %w", err)
+	}
+
+	transports := make([]string, 0, len(credential.Transport))
+	for _, t := range credential.Transport {
+		transports = append(transports, string(t))
+	}
+
+	if name == "" {
+		name = "Passkey"
+	}
+	name = truncateRunes(name, maxPasskeyNameLength)
+
+	row, err := s.db.CreateWebAuthnCredential(ctx, database.CreateWebAuthnCredentialParams{
+		UserID:          user.ID,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      transports,
+		Aaguid:          credential.Authenticator.AAGUID,
+		SignCount:       int64(credential.Authenticator.SignCount),
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+		Name:            name,
+	})
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, ErrPasskeyExists
+		}
+		return nil, fmt.Errorf("failed to store passkey: %w", err)
+	}
+	return &row, nil
+}
+
+// truncateRunes shortens s to at most n characters without splitting one
+func truncateRunes(s string, n int) string {
+	i := 0
+	for j := range s {
+		if i == n {
+			return s[:j]
+		}
+		i++
+	}
+	return s
+}
+
+// BeginLogin starts a passwordless ceremony where the authenticator picks the account
+func (s *PasskeyService) BeginLogin() (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	return s.rp.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationPreferred))
+}
+
+// FinishLogin verifies the assertion and returns the user who owns the passkey, and whether
+// the authenticator verified the user with a biometric or PIN rather than mere presence
+func (s *PasskeyService) FinishLogin(ctx context.Context, sessionData webauthn.SessionData, response *protocol.ParsedCredentialAssertionData) (*database.User, bool, error) {
+	// The library only checks expiry for ceremonies bound to a known user
+	if !sessionData.Expires.IsZero() && sessionData.Expires.Before(time.Now()) {
+		return nil, false, errors.New("passkey login failed: ceremony expired")
+	}
+
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		row, err := s.db.GetWebAuthnCredentialByCredentialID(ctx, rawID)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, ErrPasskeyNotFound
+			}
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+		if !hmac.Equal(userHandle, s.userHandle(row.UserID)) {
+			return nil, ErrPasskeyNotFound
+		}
+
+		// Deactivated users are filtered out here
+		user, err := s.db.GetUserByID(ctx, row.UserID)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, ErrPasskeyNotFound
+			}
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+		return s.loadUser(ctx, user)
+	}
+
+	found, credential, err := s.rp.ValidatePasskeyLogin(handler, sessionData, response)
+	if err != nil {
+		return nil, false, fmt.Errorf("passkey login failed: %w", err)
+	}
+	if credential.Authenticator.CloneWarning {
+		return nil, false, ErrPasskeyCloned
+	}
+
+	if err := s.db.UpdateWebAuthnCredentialUsage(ctx, database.UpdateWebAuthnCredentialUsageParams{
+		CredentialID: credential.ID,
+		SignCount:    int64(credential.Authenticator.SignCount),
+		BackupState:  credential.Flags.BackupState,
+	}); err != nil {
+		return nil, false, fmt.Errorf("failed to update passkey: %w", err)
+	}
+
+	user := found.(*passkeyUser).user
+	return &user, credential.Flags.UserVerified, nil
+}
+
+// ListPasskeys returns the user's registered passkeys
+func (s *PasskeyService) ListPasskeys(ctx context.Context, userID int32) ([]database.WebauthnCredential, error) {
+	return s.db.ListWebAuthnCredentialsByUser(ctx, userID)
+}
+
+// RenamePasskey changes the label of one of the user's passkeys
+func (s *PasskeyService) RenamePasskey(ctx context.Context, userID, id int32, name string) error {
+	n, err := s.db.RenameWebAuthnCredential(ctx, database.RenameWebAuthnCredentialParams{
+		ID:     id,
+		UserID: userID,
+		Name:   name,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rename passkey: %w", err)
+	}
+	if n == 0 {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+// RemovePasskey deletes one of the user's passkeys
+func (s *PasskeyService) RemovePasskey(ctx context.Context, userID, id int32) error {
+	n, err := s.db.DeleteWebAuthnCredential(ctx, database.DeleteWebAuthnCredentialParams{
+		ID:     id,
+		UserID: userID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove passkey: %w", err)
+	}
+	if n == 0 {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+// encodeSessionData and decodeSessionData carry ceremony state in the cookie session between begin and finish
+func encodeSessionData(data *webauthn.SessionData) (string, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode ceremony state: %w", err)
+	}
+	return string(b), nil
+}
+
+func decodeSessionData(raw interface{}) (*webauthn.SessionData, error) {
+	s, ok := raw.(string)
+	if !ok || s == "" {
+		return nil, errors.New("no passkey ceremony in progress")
+	}
+	var data webauthn.SessionData
+	if err := json.Unmarshal([]byte(s), &data); err != nil {
+		return nil, fmt.Errorf("failed to decode ceremony state: %w", err)
+	}
+	return &data, nil
+}
+
+// Session keys holding ceremony state between begin and finish
+const (
+	passkeyRegistrationKey = "webauthn_registration"
+	passkeyLoginKey        = "webauthn_login"
+)
+
+// passkeyScript converts between the JSON the server sends and the ArrayBuffers the browser API expects
+const passkeyScript = `
+<script>
+const b64urlToBuf = (s) => Uint8Array.from(atob(s.replace(/-/g, '+').replace(/_/g, '/')), c => c.charCodeAt(0)).buffer;
+const bufToB64url = (b) => btoa(String.fromCharCode(...new Uint8Array(b))).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+const postJSON = (url, body) => fetch(url, {method: 'POST', headers: {'Content-Type': 'application/json', 'Accept': 'application/json'}, body: JSON.stringify(body || {})});
+function credentialToJSON(cred) {
+	const r = cred.response;
+	const out = {id: cred.id, rawId: bufToB64url(cred.rawId), type: cred.type, response: {clientDataJSON: bufToB64url(r.clientDataJSON)}};
+	if (r.attestationObject) {
+		out.response.attestationObject = bufToB64url(r.attestationObject);
+		out.response.transports = r.getTransports ? r.getTransports() : [];
+	}
+	if (r.authenticatorData) {
+		out.response.authenticatorData = bufToB64url(r.authenticatorData);
+		out.response.signature = bufToB64url(r.signature);
+		out.response.userHandle = r.userHandle ? bufToB64url(r.userHandle) : null;
+	}
+	return out;
+}
+</script>
+`
+
+// Passkey login page (GET)
+func (h *AuthHandlers) ShowPasskeyLogin(c echo.Context) error {
+	return c.HTML(http.StatusOK, csrfScript(c)+passkeyScript+`
+		<button id="passkey-login">Sign in with a passkey</button>
+		<p id="passkey-status"></p>
+		<script>
+		document.getElementById('passkey-login').addEventListener('click', async () => {
+			const status = document.getElementById('passkey-status');
+			try {
+				const options = await (await postJSON('/login/passkey/begin')).json();
+				const pk = options.publicKey;
+				pk.challenge = b64urlToBuf(pk.challenge);
+				(pk.allowCredentials || []).forEach(c => c.id = b64urlToBuf(c.id));
+				const cred = await navigator.credentials.get({publicKey: pk});
+				const res = await postJSON('/login/passkey/finish', credentialToJSON(cred));
+				const body = await res.json();
+				if (!res.ok) throw new Error(body.error);
+				window.location = body.two_factor_required ? '/login/2fa' : body.redirect;
+			} catch (err) {
+				status.textContent = 'Passkey sign in failed: ' + err.message;
+			}
+		});
+		</script>
+	`)
+}
+
+// Start a passwordless passkey login (POST)
+func (h *AuthHandlers) BeginPasskeyLogin(c echo.Context) error {
+	options, data, err := h.passkeys.BeginLogin()
+	if err != nil {
+		slog.Error("failed to begin passkey login", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to start passkey login",
+		})
+	}
+
+	if err := h.saveCeremony(c, passkeyLoginKey, data); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save session",
+		})
+	}
+	return c.JSON(http.StatusOK, options)
+}
+
+// Complete a passwordless passkey login (POST)
+func (h *AuthHandlers) FinishPasskeyLogin(c echo.Context) error {
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to create session",
+		})
+	}
+
+	data, err := decodeSessionData(sess.Values[passkeyLoginKey])
+	delete(sess.Values, passkeyLoginKey)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "No passkey login in progress",
+		})
+	}
+
+	response, err := protocol.ParseCredentialRequestResponseBody(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid passkey response",
+		})
+	}
+
+	user, verified, err := h.passkeys.FinishLogin(c.Request().Context(), *data, response)
+	if err != nil {
+		slog.Info("passkey login rejected", slog.Any("error", err))
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Invalid credentials",
+		})
+	}
+
+	// A user-verifying passkey already combines possession and a biometric or PIN, so it is
+	// not followed by the TOTP step. A security key without a PIN only proves possession.
+	if !verified {
+		twoFactor, err := h.authService.TwoFactorEnabled(c.Request().Context(), user.ID)
+		if err != nil {
+			slog.Error("failed to check two-factor status", slog.Any("error", err))
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to create session",
+			})
+		}
+		if twoFactor {
+			return h.beginTwoFactorLogin(c, sess, user)
+		}
+	}
+
+	return h.completeLogin(c, sess, user, "passkey")
+}
+
+// Passkey settings page (GET)
+func (h *AuthHandlers) ShowPasskeys(c echo.Context) error {
+	return c.HTML(http.StatusOK, csrfScript(c)+passkeyScript+`
+		<h1>Passkeys</h1>
+		<ul id="passkeys"></ul>
+		<input type="text" id="passkey-name" placeholder="Name, e.g. My phone">
+		<button id="passkey-add">Add a passkey</button>
+		<p id="passkey-status"></p>
+		<script>
+		const status = document.getElementById('passkey-status');
+		async function load() {
+			const list = document.getElementById('passkeys');
+			list.replaceChildren();
+			const keys = await (await fetch('/api/passkeys', {headers: {'Accept': 'application/json'}})).json();
+			for (const key of keys) {
+				const li = document.createElement('li');
+				li.textContent = key.name + (key.last_used_at ? ' (last used ' + key.last_used_at + ')' : ' (never used)') + ' ';
+				const rename = document.createElement('button');
+				rename.textContent = 'Rename';
+				rename.onclick = async () => {
+					const name = prompt('New name', key.name);
+					if (!name) return;
+					await fetch('/api/passkeys/' + key.id, {method: 'PATCH', headers: {'Content-Type': 'application/json'}, body: JSON.stringify({name})});
+					load();
+				};
+				const remove = document.createElement('button');
+				remove.textContent = 'Remove';
+				remove.onclick = async () => {
+					if (!confirm('Remove ' + key.name + '?')) return;
+					await fetch('/api/passkeys/' + key.id, {method: 'DELETE'});
+					load();
+				};
+				li.append(rename, remove);
+				list.append(li);
+			}
+		}
+		document.getElementById('passkey-add').addEventListener('click', async () => {
+			try {
+				const options = await (await postJSON('/api/passkeys/register/begin')).json();
+				const pk = options.publicKey;
+				pk.challenge = b64urlToBuf(pk.challenge);
+				pk.user.id = b64urlToBuf(pk.user.id);
+				(pk.excludeCredentials || []).forEach(c => c.id = b64urlToBuf(c.id));
+				const cred = await navigator.credentials.create({publicKey: pk});
+				const name = encodeURIComponent(document.getElementById('passkey-name').value);
+				const res = await postJSON('/api/passkeys/register/finish?name=' + name, credentialToJSON(cred));
+				if (!res.ok) throw new Error((await res.json()).error);
+				status.textContent = 'Passkey added.';
+				load();
+			} catch (err) {
+				status.textContent = 'Could not add passkey: ' + err.message;
+			}
+		});
+		load();
+		</script>
+	`)
+}
+
+// Start registering a passkey for the logged in user (POST)
+func (h *AuthHandlers) BeginPasskeyRegistration(c echo.Context) error {
+	user, err := h.authService.db.GetUserByID(c.Request().Context(), c.Get("user_id").(int32))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load user",
+		})
+	}
+
+	options, data, err := h.passkeys.BeginRegistration(c.Request().Context(), user)
+	if err != nil {
+		slog.Error("failed to begin passkey registration", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to start passkey registration",
+		})
+	}
+
+	if err := h.saveCeremony(c, passkeyRegistrationKey, data); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save session",
+		})
+	}
+	return c.JSON(http.StatusOK, options)
+}
+
+// Complete registering a passkey for the logged in user (POST)
+func (h *AuthHandlers) FinishPasskeyRegistration(c echo.Context) error {
+	ctx := c.Request().Context()
+	user, err := h.authService.db.GetUserByID(ctx, c.Get("user_id").(int32))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load user",
+		})
+	}
+
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load session",
+		})
+	}
+	data, err := decodeSessionData(sess.Values[passkeyRegistrationKey])
+	delete(sess.Values, passkeyRegistrationKey)
+	sess.Save(c.Request(), c.Response())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "No passkey registration in progress",
+		})
+	}
+
+	response, err := protocol.ParseCredentialCreationResponseBody(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid passkey response",
+		})
+	}
+
+	row, err := h.passkeys.FinishRegistration(ctx, user, *data, strings.TrimSpace(c.QueryParam("name")), response)
+	if err != nil {
+		if errors.Is(err, ErrPasskeyExists) {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": ErrPasskeyExists.Error(),
+			})
+		}
+		slog.Info("passkey registration rejected", slog.Any("error", err))
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Passkey registration failed",
+		})
+	}
+
+	return c.JSON(http.StatusCreated, NewPasskeyResponse(*row))
+}
+
+// List the logged in user's passkeys (GET)
+func (h *AuthHandlers) ListPasskeys(c echo.Context) error {
+	rows, err := h.passkeys.ListPasskeys(c.Request().Context(), c.Get("user_id").(int32))
+	if err != nil {
+		slog.Error("failed to list passkeys", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list passkeys",
+		})
+	}
+
+	keys := make([]PasskeyResponse, 0, len(rows))
+	for _, row := range rows {
+		keys = append(keys, NewPasskeyResponse(row))
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+// Rename one of the logged in user's passkeys (PATCH)
+func (h *AuthHandlers) RenamePasskey(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid passkey ID",
+		})
+	}
+
+	var req struct {
+		Name string `json:"name" form:"name"`
+	}
+	err = c.Bind(&req)
+	req.Name = strings.TrimSpace(req.Name)
+	if err != nil || req.Name == "" || utf8.RuneCountInString(req.Name) > maxPasskeyNameLength {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Name must be 1-100 characters",
+		})
+	}
+
+	if err := h.passkeys.RenamePasskey(c.Request().Context(), c.Get("user_id").(int32), int32(id), req.Name); err != nil {
+		return passkeyError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Remove one of the logged in user's passkeys (DELETE)
+func (h *AuthHandlers) RemovePasskey(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid passkey ID",
+		})
+	}
+
+	if err := h.passkeys.RemovePasskey(c.Request().Context(), c.Get("user_id").(int32), int32(id)); err != nil {
+		return passkeyError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func passkeyError(c echo.Context, err error) error {
+	if errors.Is(err, ErrPasskeyNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": ErrPasskeyNotFound.Error(),
+		})
+	}
+	slog.Error("passkey update failed", slog.Any("error", err))
+	return c.JSON(http.StatusInternalServerError, map[string]string{
+		"error": "Failed to update passkey",
+	})
+}
+
+// saveCeremony stores ceremony state in the cookie session under key
+func (h *AuthHandlers) saveCeremony(c echo.Context, key string, data *webauthn.SessionData) error {
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		return err
+	}
+	encoded, err := encodeSessionData(data)
+	if err != nil {
+		return err
+	}
+	sess.Values[key] = encoded
+	return sess.Save(c.Request(), c.Response())
+}
@@ -0,0 +1,363 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+const (
+	testRPID   = "farm.example.test"
+	testOrigin = "https://farm.example.test"
+)
+
+// Authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+// softAuthenticator is a passkey in software: a P-256 key, "none" attestation and a
+// signature counter
+type softAuthenticator struct {
+	t          *testing.T
+	key        *ecdsa.PrivateKey
+	credID     []byte
+	userHandle []byte
+	signCount  uint32
+	origin     string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credID := make([]byte, 16)
+	if _, err := rand.Read(credID); err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{t: t, key: key, credID: credID, origin: testOrigin}
+}
+
+func b64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge []byte) []byte {
+	a.t.Helper()
+	b, err := json.Marshal(map[string]any{
+		"type":        ceremony,
+		"challenge":   b64url(challenge),
+		"origin":      a.origin,
+		"crossOrigin": false,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return b
+}
+
+func (a *softAuthenticator) authenticatorData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+// create answers a registration ceremony, returning the browser's JSON
+func (a *softAuthenticator) create(options *protocol.CredentialCreation) []byte {
+	a.t.Helper()
+	pub, err := a.key.PublicKey.ECDH()
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	point := pub.Bytes() // 0x04 || x || y
+	coseKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: point[1:33],
+		YCoord: point[33:],
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	attested := make([]byte, 16) // zero AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credID)))
+	attested = append(attested, a.credID...)
+	attested = append(attested, coseKey...)
+
+	attestation, err := webauthncbor.Marshal(struct {
+		Format    string         `cbor:"fmt"`
+		Statement map[string]any `cbor:"attStmt"`
+		AuthData  []byte         `cbor:"authData"`
+	}{"none", map[string]any{}, a.authenticatorData(flagUserPresent|flagUserVerified|flagAttestedData, attested)})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return a.credentialJSON(map[string]any{
+		"clientDataJSON":    b64url(a.clientData("webauthn.create", options.Response.Challenge)),
+		"attestationObject": b64url(attestation),
+		"transports":        []string{"internal"},
+	})
+}
+
+// get answers a login ceremony, returning the browser's JSON
+func (a *softAuthenticator) get(options *protocol.CredentialAssertion, flags byte) []byte {
+	a.t.Helper()
+	a.signCount++
+	authData := a.authenticatorData(flags, nil)
+	clientData := a.clientData("webauthn.get", options.Response.Challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(bytes.Clone(authData), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return a.credentialJSON(map[string]any{
+		"clientDataJSON":    b64url(clientData),
+		"authenticatorData": b64url(authData),
+		"signature":         b64url(signature),
+		"userHandle":        b64url(a.userHandle),
+	})
+}
+
+func (a *softAuthenticator) credentialJSON(response map[string]any) []byte {
+	a.t.Helper()
+	b, err := json.Marshal(map[string]any{
+		"id":       b64url(a.credID),
+		"rawId":    b64url(a.credID),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return b
+}
+
+func newTestPasskeyService(t *testing.T, db *fakeDB) *PasskeyService {
+	t.Helper()
+	s, err := NewPasskeyService(database.New(db), RelyingPartyConfig{
+		ID:          testRPID,
+		DisplayName: "South Texas Farmer",
+		Origins:     []string{testOrigin},
+	}, []byte("test-handle-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// registerPasskey runs a registration ceremony for user with authenticator
+func registerPasskey(t *testing.T, s *PasskeyService, user database.User, authenticator *softAuthenticator, name string) *database.WebauthnCredential {
+	t.Helper()
+	ctx := context.Background()
+	options, sessionData, err := s.BeginRegistration(ctx, user)
+	if err != nil {
+		t.Fatalf("BeginRegistration: %v", err)
+	}
+	authenticator.userHandle = s.userHandle(user.ID)
+
+	response, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(authenticator.create(options)))
+	if err != nil {
+		t.Fatalf("ParseCredentialCreationResponseBody: %v", err)
+	}
+	row, err := s.FinishRegistration(ctx, user, *sessionData, name, response)
+	if err != nil {
+		t.Fatalf("FinishRegistration: %v", err)
+	}
+	return row
+}
+
+// loginWithPasskey runs a login ceremony with authenticator
+func loginWithPasskey(t *testing.T, s *PasskeyService, authenticator *softAuthenticator, flags byte) (*database.User, bool, error) {
+	t.Helper()
+	options, sessionData, err := s.BeginLogin()
+	if err != nil {
+		t.Fatalf("BeginLogin: %v", err)
+	}
+	response, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(authenticator.get(options, flags)))
+	if err != nil {
+		t.Fatalf("ParseCredentialRequestResponseBody: %v", err)
+	}
+	return s.FinishLogin(context.Background(), *sessionData, response)
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	tests := []struct {
+		name     string
+		label    string
+		wantName string
+	}{
+		{"default name", "", "Passkey"},
+		{"given name", "My phone", "My phone"},
+		{"long name cut by character", strings.Repeat("é", 150), strings.Repeat("é", maxPasskeyNameLength)},
+		{"long name of wide characters", strings.Repeat("🌽", 101), strings.Repeat("🌽", maxPasskeyNameLength)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, db := newTestAuthService(t)
+			user := db.addUser(t, a, "grower", "correct horse battery staple")
+			s := newTestPasskeyService(t, db)
+			authenticator := newSoftAuthenticator(t)
+
+			row := registerPasskey(t, s, *user, authenticator, tt.label)
+			if row.Name != tt.wantName || !utf8.ValidString(row.Name) {
+				t.Errorf("stored name %q, want %q", row.Name, tt.wantName)
+			}
+			if row.UserID != user.ID || !bytes.Equal(row.CredentialID, authenticator.credID) {
+				t.Errorf("stored passkey %+v does not belong to the authenticator", row)
+			}
+			if row.AttestationType != "none" {
+				t.Errorf("attestation type %q, want none", row.AttestationType)
+			}
+		})
+	}
+}
+
+func TestPasskeyRegistrationRefusesDuplicate(t *testing.T) {
+	a, db := newTestAuthService(t)
+	user := db.addUser(t, a, "grower", "correct horse battery staple")
+	s := newTestPasskeyService(t, db)
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, s, *user, authenticator, "")
+
+	ctx := context.Background()
+	options, sessionData, err := s.BeginRegistration(ctx, *user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(options.Response.CredentialExcludeList); n != 1 {
+		t.Errorf("registration excludes %d passkeys, want the one already registered", n)
+	}
+	response, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(authenticator.create(options)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FinishRegistration(ctx, *user, *sessionData, "", response); !errors.Is(err, ErrPasskeyExists) {
+		t.Errorf("err = %v, want ErrPasskeyExists", err)
+	}
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	a, db := newTestAuthService(t)
+	user := db.addUser(t, a, "grower", "correct horse battery staple")
+	s := newTestPasskeyService(t, db)
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, s, *user, authenticator, "")
+
+	got, verified, err := loginWithPasskey(t, s, authenticator, flagUserPresent|flagUserVerified)
+	if err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	if got.ID != user.ID || !verified {
+		t.Errorf("FinishLogin = (user %d, verified %v), want (user %d, verified true)", got.ID, verified, user.ID)
+	}
+	if stored := db.passkeys[string(authenticator.credID)]; stored.SignCount != 1 || !stored.LastUsedAt.Valid {
+		t.Errorf("passkey usage not recorded: sign count %d, last used %v", stored.SignCount, stored.LastUsedAt)
+	}
+
+	// A security key without a PIN proves possession only, which callers follow with TOTP
+	_, verified, err = loginWithPasskey(t, s, authenticator, flagUserPresent)
+	if err != nil {
+		t.Fatalf("FinishLogin without user verification: %v", err)
+	}
+	if verified {
+		t.Error("presence-only login reported as user verified")
+	}
+}
+
+func TestPasskeyLoginRefused(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(t *testing.T, db *fakeDB, user *database.User, authenticator *softAuthenticator)
+		wantErr error
+	}{
+		{"counter went backwards", func(t *testing.T, db *fakeDB, user *database.User, authenticator *softAuthenticator) {
+			authenticator.signCount = 0
+		}, ErrPasskeyCloned},
+		{"other origin", func(t *testing.T, db *fakeDB, user *database.User, authenticator *softAuthenticator) {
+			authenticator.origin = "https://evil.example"
+		}, nil},
+		{"signed with another key", func(t *testing.T, db *fakeDB, user *database.User, authenticator *softAuthenticator) {
+			authenticator.key = newSoftAuthenticator(t).key
+		}, nil},
+		{"unknown passkey", func(t *testing.T, db *fakeDB, user *database.User, authenticator *softAuthenticator) {
+			authenticator.credID = newSoftAuthenticator(t).credID
+		}, nil},
+		{"user handle of another account", func(t *testing.T, db *fakeDB, user *database.User, authenticator *softAuthenticator) {
+			authenticator.userHandle = bytes.Repeat([]byte{1}, len(authenticator.userHandle))
+		}, nil},
+		{"owner deactivated", func(t *testing.T, db *fakeDB, user *database.User, authenticator *softAuthenticator) {
+			db.setActive(user.ID, false)
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, db := newTestAuthService(t)
+			user := db.addUser(t, a, "grower", "correct horse battery staple")
+			s := newTestPasskeyService(t, db)
+			authenticator := newSoftAuthenticator(t)
+			registerPasskey(t, s, *user, authenticator, "")
+
+			// One good login so the stored counter is past zero
+			if _, _, err := loginWithPasskey(t, s, authenticator, flagUserPresent|flagUserVerified); err != nil {
+				t.Fatalf("FinishLogin: %v", err)
+			}
+
+			tt.tamper(t, db, user, authenticator)
+			got, _, err := loginWithPasskey(t, s, authenticator, flagUserPresent|flagUserVerified)
+			if err == nil {
+				t.Fatalf("login succeeded as user %d", got.ID)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTruncateRunes(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"", 3, ""},
+		{"abc", 3, "abc"},
+		{"abcd", 3, "abc"},
+		{"héllo", 2, "hé"},
+		{"🌽🌽🌽", 2, "🌽🌽"},
+		{"abc", 0, ""},
+	}
+	for _, tt := range tests {
+		if got := truncateRunes(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncateRunes(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
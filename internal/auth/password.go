@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy sets the rules a new password must meet
+type PasswordPolicy struct {
+	MinLength  int           // in characters
+	MaxLength  int           // in bytes, see PasswordHasher.MaxPasswordLength
+	MinEntropy float64       // estimated bits, see estimateEntropy
+	Breaches   *BreachCorpus // when set, passwords found in it are refused
+}
+
+// DefaultPasswordPolicy is used when no policy is configured
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:  8,
+		MaxLength:  72,
+		MinEntropy: 35,
+	}
+}
+
+// Check returns a message describing why password is unacceptable for the account with the
+// given username and email, or "" if it meets the policy
+func (p PasswordPolicy) Check(password, username, email string) string {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Sprintf("Password must be at least %d characters", p.MinLength)
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		return fmt.Sprintf("Password must be at most %d bytes", p.MaxLength)
+	}
+	if containsIdentity(password, username, email) {
+		return "Password must not contain your username or email address"
+	}
+	if estimateEntropy(password) < p.MinEntropy {
+		return "Password is too easy to guess; use a longer mix of words, numbers and symbols"
+	}
+	if p.Breaches != nil {
+		breached, err := p.Breaches.Contains(password)
+		if err != nil {
+			// The corpus is a second line of defence, so a bad bucket does not block sign-ups
+			slog.Error("failed to check breached passwords", slog.Any("error", err))
+		}
+		if breached {
+			return "This password has appeared in a data breach; choose a different one"
+		}
+	}
+	return ""
+}
+
+// containsIdentity reports whether password includes the username, the email address or
+// the email's local part, ignoring case. Very short values are skipped to avoid false matches.
+func containsIdentity(password, username, email string) bool {
+	password = strings.ToLower(password)
+	local, _, _ := strings.Cut(email, "@")
+	for _, part := range []string{username, email, local} {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if len(part) >= 3 && strings.Contains(password, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// estimateEntropy gives a rough strength in bits: the size of the character pool the password
+// draws from, raised to its length, where repeated and sequential characters ("aaa", "abc",
+// "321") only count for half
+func estimateEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	var length float64
+	prev := rune(-1)
+	for _, r := range password {
+		switch {
+		case r > unicode.MaxASCII:
+			other = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+
+		if prev >= 0 && (r == prev || r == prev+1 || r == prev-1) {
+			length += 0.5
+		} else {
+			length++
+		}
+		prev = r
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.present {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return length * math.Log2(float64(pool))
+}
+
+// BreachCorpus is an offline list of breached passwords laid out like the Pwned Passwords
+// range API: SHA-1 hashes split into one file per 5-character hex prefix, named
+// "<PREFIX>.txt" and holding "<SUFFIX>:<COUNT>" lines. Only the matching bucket is read
+// for each lookup, so the full corpus never has to fit in memory.
+type BreachCorpus struct {
+	dir string
+}
+
+// OpenBreachCorpus uses the bucket files in dir
+func OpenBreachCorpus(dir string) (*BreachCorpus, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breach corpus: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("breach corpus %s is not a directory", dir)
+	}
+	return &BreachCorpus{dir: dir}, nil
+}
+
+// Contains reports whether password appears in the corpus
+func (b *BreachCorpus) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to open breach bucket %s: %w", prefix, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		candidate, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		// Padding entries in downloaded ranges have a count of zero
+		if strings.EqualFold(candidate, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("failed to read breach bucket %s: %w", prefix, err)
+	}
+	return false, nil
+}
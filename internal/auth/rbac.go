@@ -0,0 +1,486 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/labstack/echo/v4"
+)
+
+// Built-in roles, seeded by migration
+const (
+	RoleAdmin   = "admin"
+	RoleManager = "manager"
+	RoleWorker  = "worker"
+	RoleViewer  = "viewer"
+
+	// DefaultRole is granted to self-registered accounts
+	DefaultRole = RoleViewer
+)
+
+// Built-in permissions, seeded by migration
+const (
+	PermFilesRead        = "files:read"
+	PermFilesWrite       = "files:write"
+	PermFilesDelete      = "files:delete"
+	PermUsersRead        = "users:read"
+	PermUsersManage      = "users:manage"
+	PermUsersImpersonate = "users:impersonate"
+	PermRolesManage      = "roles:manage"
+	PermAuditRead        = "audit:read"
+)
+
+// RBAC errors
+var (
+	ErrRoleNotFound       = errors.New("role not found")
+	ErrRoleExists         = errors.New("role already exists")
+	ErrPermissionNotFound = errors.New("permission not found")
+	ErrSystemRole         = errors.New("system roles cannot be deleted")
+)
+
+// Context keys used to share the service and the per-request access cache between middleware
+const (
+	authServiceContextKey = "auth_service"
+	accessContextKey      = "access"
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z0-9_-]{2,50}$`)
+
+// Access is the set of roles and permissions held by a user
+type Access struct {
+	Roles       []string
+	Permissions map[string]bool
+	Scopes      map[string]bool // when set, the request used an API token limited to these permissions
+}
+
+// HasRole reports whether the user holds role
+func (a *Access) HasRole(role string) bool {
+	for _, r := range a.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether the user holds permission. Admins can do everything,
+// including permissions added after their role was seeded.
+func (a *Access) Can(permission string) bool {
+	if a.Scopes != nil && !a.Scopes[permission] {
+		return false
+	}
+	return a.HasRole(RoleAdmin) || a.Permissions[permission]
+}
+
+// Covers reports whether the user holds everything other does, so acting on other's account
+// cannot lead to more access than the user already has
+func (a *Access) Covers(other *Access) bool {
+	if other.HasRole(RoleAdmin) && !a.HasRole(RoleAdmin) {
+		return false
+	}
+	for permission := range other.Permissions {
+		if !a.Can(permission) {
+			return false
+		}
+	}
+	return true
+}
+
+// UserAccess loads the user's roles and effective permissions
+func (a *AuthService) UserAccess(ctx context.Context, userID int32) (*Access, error) {
+	roles, err := a.db.ListUserRoles(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load roles: %w", err)
+	}
+	permissions, err := a.db.ListUserPermissions(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load permissions: %w", err)
+	}
+
+	access := &Access{Roles: roles, Permissions: make(map[string]bool, len(permissions))}
+	for _, p := range permissions {
+		access.Permissions[p] = true
+	}
+	return access, nil
+}
+
+// AssignRole grants role to the user. Granting a role the user already holds is not an error.
+func (a *AuthService) AssignRole(ctx context.Context, userID int32, role string) error {
+	if _, err := a.db.GetRoleByName(ctx, role); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrRoleNotFound
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	if _, err := a.db.AssignUserRole(ctx, database.AssignUserRoleParams{
+		UserID:   userID,
+		RoleName: role,
+	}); err != nil {
+		return fmt.Errorf("failed to assign role: %w", err)
+	}
+	a.requireSessionRotation(ctx, userID)
+	a.recordSecurityEvent(ctx, EventRoleGranted, slog.Any("user_id", userID), slog.String("role", role))
+	return nil
+}
+
+// RemoveRole takes role away from the user
+func (a *AuthService) RemoveRole(ctx context.Context, userID int32, role string) error {
+	n, err := a.db.RemoveUserRole(ctx, database.RemoveUserRoleParams{
+		UserID:   userID,
+		RoleName: role,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove role: %w", err)
+	}
+	if n == 0 {
+		return ErrRoleNotFound
+	}
+	a.requireSessionRotation(ctx, userID)
+	a.recordSecurityEvent(ctx, EventRoleRevoked, slog.Any("user_id", userID), slog.String("role", role))
+	return nil
+}
+
+// CreateRole adds a custom role with the given permissions
+func (a *AuthService) CreateRole(ctx context.Context, name, description string, permissions []string) (*database.Role, error) {
+	if !roleNamePattern.MatchString(name) {
+		return nil, ValidationErrors{"name": "Role name must be 2-50 characters of lowercase letters, numbers, '_' or '-'"}
+	}
+
+	// Check every permission before creating anything, so a bad name cannot leave the role
+	// behind with only some of its permissions
+	known, err := a.db.ListPermissions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	for _, permission := range permissions {
+		if !permissionExists(known, permission) {
+			return nil, ErrPermissionNotFound
+		}
+	}
+
+	role, err := a.db.CreateRole(ctx, database.CreateRoleParams{
+		Name:        name,
+		Description: database.StringToPgText(description),
+	})
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, ErrRoleExists
+		}
+		return nil, fmt.Errorf("failed to create role: %w", err)
+	}
+
+	for _, permission := range permissions {
+		if err := a.GrantPermission(ctx, name, permission); err != nil {
+			return nil, err
+		}
+	}
+	return &role, nil
+}
+
+// DeleteRole removes a custom role and all of its assignments
+func (a *AuthService) DeleteRole(ctx context.Context, name string) error {
+	role, err := a.db.GetRoleByName(ctx, name)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrRoleNotFound
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
+	if role.IsSystem {
+		return ErrSystemRole
+	}
+
+	if _, err := a.db.DeleteRole(ctx, name); err != nil {
+		return fmt.Errorf("failed to delete role: %w", err)
+	}
+	return nil
+}
+
+// GrantPermission adds permission to role. Everyone holding the role gets a new session ID
+// on their next request.
+func (a *AuthService) GrantPermission(ctx context.Context, role, permission string) error {
+	n, err := a.db.GrantRolePermission(ctx, database.GrantRolePermissionParams{
+		RoleName:       role,
+		PermissionName: permission,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to grant permission: %w", err)
+	}
+	if n == 0 {
+		// Either already granted, or the role or permission does not exist
+		return a.checkRoleAndPermission(ctx, role, permission)
+	}
+	a.requireRoleSessionRotation(ctx, role)
+	a.recordSecurityEvent(ctx, EventRolePermissionGranted, slog.String("role", role), slog.String("permission", permission))
+	return nil
+}
+
+// RevokePermission removes permission from role. Everyone holding the role gets a new session
+// ID on their next request.
+func (a *AuthService) RevokePermission(ctx context.Context, role, permission string) error {
+	n, err := a.db.RevokeRolePermission(ctx, database.RevokeRolePermissionParams{
+		RoleName:       role,
+		PermissionName: permission,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke permission: %w", err)
+	}
+	if n == 0 {
+		return a.checkRoleAndPermission(ctx, role, permission)
+	}
+	a.requireRoleSessionRotation(ctx, role)
+	a.recordSecurityEvent(ctx, EventRolePermissionRevoked, slog.String("role", role), slog.String("permission", permission))
+	return nil
+}
+
+func (a *AuthService) checkRoleAndPermission(ctx context.Context, role, permission string) error {
+	if _, err := a.db.GetRoleByName(ctx, role); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrRoleNotFound
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	permissions, err := a.db.ListPermissions(ctx)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if !permissionExists(permissions, permission) {
+		return ErrPermissionNotFound
+	}
+	return nil
+}
+
+// currentAccess returns the logged in user's access, loading it at most once per request
+func currentAccess(c echo.Context) (*Access, error) {
+	if access, ok := c.Get(accessContextKey).(*Access); ok {
+		return access, nil
+	}
+
+	authService, ok := c.Get(authServiceContextKey).(*AuthService)
+	if !ok {
+		return nil, errors.New("AuthMiddleware must run before role checks")
+	}
+	userID, ok := c.Get("user_id").(int32)
+	if !ok {
+		return nil, errors.New("no user in context")
+	}
+
+	access, err := authService.UserAccess(c.Request().Context(), userID)
+	if err != nil {
+		return nil, err
+	}
+	if scopes, ok := c.Get(apiTokenScopesContextKey).([]string); ok {
+		access.Scopes = make(map[string]bool, len(scopes))
+		for _, scope := range scopes {
+			access.Scopes[scope] = true
+		}
+	}
+	c.Set(accessContextKey, access)
+	return access, nil
+}
+
+// RequirePermission only lets through users holding permission. It must run after AuthMiddleware.
+func RequirePermission(permission string) echo.MiddlewareFunc {
+	return requireAccess(func(a *Access) bool { return a.Can(permission) })
+}
+
+// RequireRole only lets through users holding role. It must run after AuthMiddleware.
+func RequireRole(role string) echo.MiddlewareFunc {
+	return requireAccess(func(a *Access) bool { return a.HasRole(role) })
+}
+
+func requireAccess(allowed func(*Access) bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			access, err := currentAccess(c)
+			if err != nil {
+				slog.Error("failed to load user access", slog.Any("error", err))
+				return c.JSON(http.StatusInternalServerError, map[string]string{
+					"error": "Failed to check permissions",
+				})
+			}
+
+			if !allowed(access) {
+				if wantsJSONError(c) {
+					return c.JSON(http.StatusForbidden, map[string]string{
+						"error": "You do not have permission to do that",
+					})
+				}
+				return c.String(http.StatusForbidden, "You do not have permission to view this page.")
+			}
+			return next(c)
+		}
+	}
+}
+
+// List roles with their permissions (GET)
+func (h *AuthHandlers) ListRoles(c echo.Context) error {
+	ctx := c.Request().Context()
+	roles, err := h.authService.db.ListRoles(ctx)
+	if err != nil {
+		slog.Error("failed to list roles", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list roles",
+		})
+	}
+
+	out := make([]RoleResponse, 0, len(roles))
+	for _, role := range roles {
+		permissions, err := h.authService.db.ListRolePermissions(ctx, role.Name)
+		if err != nil {
+			slog.Error("failed to list role permissions", slog.Any("error", err))
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to list roles",
+			})
+		}
+		out = append(out, NewRoleResponse(role, permissions))
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// List every known permission (GET)
+func (h *AuthHandlers) ListPermissions(c echo.Context) error {
+	permissions, err := h.authService.db.ListPermissions(c.Request().Context())
+	if err != nil {
+		slog.Error("failed to list permissions", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list permissions",
+		})
+	}
+
+	out := make([]PermissionResponse, 0, len(permissions))
+	for _, p := range permissions {
+		out = append(out, NewPermissionResponse(p))
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// Create a custom role (POST)
+func (h *AuthHandlers) CreateRole(c echo.Context) error {
+	var req struct {
+		Name        string   `json:"name" form:"name"`
+		Description string   `json:"description" form:"description"`
+		Permissions []string `json:"permissions" form:"permissions"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid role request",
+		})
+	}
+
+	role, err := h.authService.CreateRole(c.Request().Context(), strings.TrimSpace(req.Name), strings.TrimSpace(req.Description), req.Permissions)
+	if err != nil {
+		return rbacError(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, NewRoleResponse(*role, req.Permissions))
+}
+
+// Delete a custom role (DELETE)
+func (h *AuthHandlers) DeleteRole(c echo.Context) error {
+	if err := h.authService.DeleteRole(c.Request().Context(), c.Param("role")); err != nil {
+		return rbacError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Add a permission to a role (PUT)
+func (h *AuthHandlers) GrantRolePermission(c echo.Context) error {
+	if err := h.authService.GrantPermission(c.Request().Context(), c.Param("role"), c.Param("permission")); err != nil {
+		return rbacError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Remove a permission from a role (DELETE)
+func (h *AuthHandlers) RevokeRolePermission(c echo.Context) error {
+	if err := h.authService.RevokePermission(c.Request().Context(), c.Param("role"), c.Param("permission")); err != nil {
+		return rbacError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// List a user's roles (GET)
+func (h *AuthHandlers) ListUserRoles(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	roles, err := h.authService.db.ListUserRoles(c.Request().Context(), int32(userID))
+	if err != nil {
+		slog.Error("failed to list user roles", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list roles",
+		})
+	}
+	return c.JSON(http.StatusOK, roles)
+}
+
+// Grant a role to a user (PUT)
+func (h *AuthHandlers) AssignUserRole(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	if err := h.authService.AssignRole(c.Request().Context(), int32(userID), c.Param("role")); err != nil {
+		return rbacError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Take a role away from a user (DELETE)
+func (h *AuthHandlers) RemoveUserRole(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	if err := h.authService.RemoveRole(c.Request().Context(), int32(userID), c.Param("role")); err != nil {
+		return rbacError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func rbacError(c echo.Context, err error) error {
+	var validationErrs ValidationErrors
+	switch {
+	case errors.As(err, &validationErrs):
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":  "Invalid role details",
+			"fields": validationErrs,
+		})
+	case errors.Is(err, ErrRoleNotFound), errors.Is(err, ErrPermissionNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": err.Error(),
+		})
+	case errors.Is(err, ErrRoleExists), errors.Is(err, ErrSystemRole):
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": err.Error(),
+		})
+	default:
+		slog.Error("role update failed", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to update roles",
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+)
+
+// Where to send the user after login when there is nowhere better
+const defaultLoginRedirect = "/dashboard"
+
+// wantsJSONError reports whether a failed auth check should be answered with a JSON error
+// instead of a redirect: API routes, JSON callers and htmx requests, none of which can
+// usefully follow a redirect to an HTML login page
+func wantsJSONError(c echo.Context) bool {
+	return wantsJSON(c) || c.Request().Header.Get("HX-Request") == "true"
+}
+
+// unauthenticated sends browsers to the login page, remembering where they were going,
+// and tells API and script callers to authenticate
+func unauthenticated(c echo.Context, message string) error {
+	if wantsJSONError(c) {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="api"`)
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error":     message,
+			"login_url": "/login",
+		})
+	}
+
+	target := "/login"
+	if c.Request().Method == http.MethodGet {
+		if next := safeNext(c.Request().URL.RequestURI()); next != "" {
+			target += "?next=" + url.QueryEscape(next)
+		}
+	}
+	return c.Redirect(http.StatusFound, target)
+}
+
+// safeNext returns next if it is a local path that is safe to redirect to after login,
+// or "" if it could send the user to another site or straight back to the login page
+func safeNext(next string) string {
+	// "//host" and "/\host" are treated as other hosts by browsers
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.ContainsAny(next, "\\\r\n\t") {
+		return ""
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return ""
+	}
+	if u.Path == "/login" || strings.HasPrefix(u.Path, "/login/") || u.Path == "/logout" {
+		return ""
+	}
+	return next
+}
+
+// rememberReturnTo stores the validated next parameter for whichever login method finishes,
+// or forgets a stale one
+func rememberReturnTo(sess *sessions.Session, next string) {
+	if next = safeNext(next); next != "" {
+		sess.Values[ReturnToKey] = next
+	} else {
+		delete(sess.Values, ReturnToKey)
+	}
+}
+
+// takeReturnTo removes and returns where the user should land after logging in
+func takeReturnTo(sess *sessions.Session) string {
+	next, _ := sess.Values[ReturnToKey].(string)
+	delete(sess.Values, ReturnToKey)
+	if next = safeNext(next); next != "" {
+		return next
+	}
+	return defaultLoginRedirect
+}
@@ -0,0 +1,57 @@
+package auth
+
+import "testing"
+
+func TestSafeNext(t *testing.T) {
+	tests := []struct {
+		name string
+		next string
+		want string
+	}{
+		{"local path", "/dashboard", "/dashboard"},
+		{"query and fragment", "/files?folder=2&sort=name#top", "/files?folder=2&sort=name#top"},
+		{"root", "/", "/"},
+		{"empty", "", ""},
+		{"relative path", "dashboard", ""},
+
+		// Browsers treat these as other hosts
+		{"protocol-relative", "//evil.example", ""},
+		{"protocol-relative with path", "//evil.example/dashboard", ""},
+		{"triple slash", "///evil.example", ""},
+		{"backslash", "/\\evil.example", ""},
+		{"backslashes only", "\\\\evil.example", ""},
+		{"slash backslash slash", "/\\/evil.example", ""},
+
+		// Absolute URLs and other schemes
+		{"https", "https://evil.example/", ""},
+		{"scheme without slashes", "https:evil.example", ""},
+		{"javascript", "javascript:alert(1)", ""},
+		{"data", "data:text/html,<script>alert(1)</script>", ""},
+		{"mixed case scheme", "HtTpS://evil.example", ""},
+
+		// Whitespace browsers strip before resolving the URL
+		{"tab", "/\t/evil.example", ""},
+		{"newline", "/\n/evil.example", ""},
+		{"carriage return", "/\r/evil.example", ""},
+
+		// Encoded slashes stay encoded in the Location header, so they name a local path
+		{"encoded slashes", "/%2F%2Fevil.example", "/%2F%2Fevil.example"},
+		{"encoded backslash", "/%5Cevil.example", "/%5Cevil.example"},
+		{"encoded slashes without leading slash", "%2F%2Fevil.example", ""},
+
+		// Sending the user back to login would loop
+		{"login", "/login", ""},
+		{"login with query", "/login?next=/dashboard", ""},
+		{"second factor", "/login/2fa", ""},
+		{"passkey login", "/login/passkey", ""},
+		{"logout", "/logout", ""},
+		{"login prefix of another page", "/login-help", "/login-help"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := safeNext(tt.next); got != tt.want {
+				t.Errorf("safeNext(%q) = %q, want %q", tt.next, got, tt.want)
+			}
+		})
+	}
+}
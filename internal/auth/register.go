@@ -0,0 +1,338 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/dukerupert/south-texas-farmer/internal/mailer"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Registration errors
+var (
+	ErrUserExists = errors.New("username or email is already registered")
+)
+
+// How long an email verification link stays valid
+const verificationTokenTTL = 24 * time.Hour
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,50}$`)
+
+// NormalizeUsername applies NFKC so look-alike forms such as fullwidth letters become the
+// plain characters usernames are checked and stored with
+func NormalizeUsername(username string) string {
+	return norm.NFKC.String(strings.TrimSpace(username))
+}
+
+// RegisterRequest is the input for self-service registration
+type RegisterRequest struct {
+	Username  string `json:"username" form:"username"`
+	Email     string `json:"email" form:"email"`
+	Password  string `json:"password" form:"password"`
+	FirstName string `json:"first_name" form:"first_name"`
+	LastName  string `json:"last_name" form:"last_name"`
+}
+
+// ValidationErrors maps field names to a problem with that field
+type ValidationErrors map[string]string
+
+func (v ValidationErrors) Error() string {
+	return "validation failed"
+}
+
+// Validate normalises the request and reports every invalid field, checking the password against policy
+func (r *RegisterRequest) Validate(policy PasswordPolicy) error {
+	r.Username = NormalizeUsername(r.Username)
+	r.Email = strings.TrimSpace(r.Email)
+	r.FirstName = strings.TrimSpace(r.FirstName)
+	r.LastName = strings.TrimSpace(r.LastName)
+
+	errs := ValidationErrors{}
+	if !usernamePattern.MatchString(r.Username) {
+		errs["username"] = "Username must be 3-50 characters of letters, numbers, '.', '_' or '-'"
+	}
+	if addr, err := mail.ParseAddress(r.Email); err != nil || addr.Address != r.Email || len(r.Email) > 255 {
+		errs["email"] = "A valid email address is required"
+	}
+	if msg := policy.Check(r.Password, r.Username, r.Email); msg != "" {
+		errs["password"] = msg
+	}
+	if len(r.FirstName) > 100 {
+		errs["first_name"] = "First name must be at most 100 characters"
+	}
+	if len(r.LastName) > 100 {
+		errs["last_name"] = "Last name must be at most 100 characters"
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Register creates an unverified account and emails a verification link
+func (a *AuthService) Register(ctx context.Context, req RegisterRequest) (*database.CreateUserRow, error) {
+	if err := req.Validate(a.passwords); err != nil {
+		return nil, err
+	}
+
+	hashedPassword, err := a.HashPassword(req.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := a.db.CreateUser(ctx, database.CreateUserParams{
+		Username:     req.Username,
+		Email:        req.Email,
+		PasswordHash: hashedPassword,
+		FirstName:    database.StringToPgText(req.FirstName),
+		LastName:     database.StringToPgText(req.LastName),
+	})
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, ErrUserExists
+		}
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	if err := a.AssignRole(ctx, user.ID, DefaultRole); err != nil {
+		slog.Error("failed to assign default role", slog.Any("user_id", user.ID), slog.Any("error", err))
+	}
+
+	// The account exists even if the email fails; the user can ask for another link
+	if err := a.SendVerificationEmail(ctx, user.ID, user.Username, user.Email); err != nil {
+		slog.Error("failed to send verification email", slog.Any("user_id", user.ID), slog.Any("error", err))
+	}
+
+	return &user, nil
+}
+
+// SendVerificationEmail signs a verification token bound to the address and mails the link
+func (a *AuthService) SendVerificationEmail(ctx context.Context, userID int32, username, email string) error {
+	token, err := a.tokens.Sign(PurposeVerifyEmail, userID, email, verificationTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", a.baseURL, token)
+	return a.mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nConfirm your email address by opening the link below:\n\n%s\n\nThe link expires in 24 hours. If you did not create an account, you can ignore this message.\n",
+			username, link),
+	})
+}
+
+// VerifyEmail checks a verification token and marks the account verified
+func (a *AuthService) VerifyEmail(ctx context.Context, token string) (int32, error) {
+	claims, err := a.tokens.Verify(PurposeVerifyEmail, token)
+	if err != nil {
+		return 0, err
+	}
+
+	user, err := a.db.GetUserByID(ctx, claims.UserID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrInvalidToken
+		}
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+
+	// A token issued for an old address must not verify a new one
+	if user.Email != claims.Subject {
+		return 0, ErrInvalidToken
+	}
+
+	if err := a.db.VerifyUser(ctx, user.ID); err != nil {
+		return 0, fmt.Errorf("failed to verify user: %w", err)
+	}
+	a.forgetUser(user.ID)
+	return user.ID, nil
+}
+
+// RequireVerifiedMiddleware restricts routes to users who confirmed their email
+func RequireVerifiedMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// Set from the loaded user by AuthMiddleware, or by APIAuthMiddleware for token requests
+			if verified, ok := c.Get(IsVerifiedKey).(bool); ok {
+				if verified {
+					return next(c)
+				}
+			} else if sess, err := session.Get(SessionName, c); err == nil {
+				if verified, ok := sess.Values[IsVerifiedKey].(bool); ok && verified {
+					return next(c)
+				}
+			}
+
+			if wantsJSONError(c) {
+				return c.JSON(http.StatusForbidden, map[string]string{
+					"error": "Email address not verified",
+				})
+			}
+			return c.Redirect(http.StatusFound, "/verify-email/pending")
+		}
+	}
+}
+
+// wantsJSON reports whether the client sent or asked for JSON
+func wantsJSON(c echo.Context) bool {
+	req := c.Request()
+	return strings.HasPrefix(req.Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) ||
+		strings.Contains(req.Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON) ||
+		strings.HasPrefix(c.Path(), "/api/")
+}
+
+// Registration form (GET)
+func (h *AuthHandlers) ShowRegister(c echo.Context) error {
+	return c.HTML(http.StatusOK, `
+		<form method="POST" action="/register">
+			`+csrfField(c)+`
+			<input type="text" name="username" placeholder="Username" required>
+			<input type="email" name="email" placeholder="Email" required>
+			<input type="text" name="first_name" placeholder="First name">
+			<input type="text" name="last_name" placeholder="Last name">
+			<input type="password" name="password" placeholder="Password" required>
+			<button type="submit">Register</button>
+		</form>
+	`)
+}
+
+// Registration handler (POST), accepts a form or a JSON body
+func (h *AuthHandlers) Register(c echo.Context) error {
+	var req RegisterRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid registration request",
+		})
+	}
+
+	user, err := h.authService.Register(c.Request().Context(), req)
+	if err != nil {
+		var validationErrs ValidationErrors
+		switch {
+		case errors.As(err, &validationErrs):
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"error":  "Invalid registration details",
+				"fields": validationErrs,
+			})
+		case errors.Is(err, ErrUserExists):
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": ErrUserExists.Error(),
+			})
+		default:
+			slog.Error("registration failed", slog.Any("error", err))
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Registration failed",
+			})
+		}
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(http.StatusCreated, map[string]interface{}{
+			"message": "Registration successful, check your email to verify your account",
+			"user":    newListedUserResponse(database.ListUsersRow(*user)),
+		})
+	}
+	return c.HTML(http.StatusCreated, `
+		<p>Registration successful. Check your email for a link to verify your account.</p>
+		<p><a href="/login">Continue to login</a></p>
+	`)
+}
+
+// Email verification link target (GET)
+func (h *AuthHandlers) VerifyEmail(c echo.Context) error {
+	userID, err := h.authService.VerifyEmail(c.Request().Context(), c.QueryParam("token"))
+	if err != nil {
+		if errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrExpiredToken) {
+			return c.HTML(http.StatusBadRequest, `
+				<p>This verification link is invalid or has expired.</p>
+				<p><a href="/login">Log in</a> to request a new one.</p>
+			`)
+		}
+		slog.Error("email verification failed", slog.Any("error", err))
+		return c.HTML(http.StatusInternalServerError, `<p>Verification failed, please try again later.</p>`)
+	}
+
+	// Lift the restriction on the current session if it belongs to the verified user
+	if sess, err := session.Get(SessionName, c); err == nil {
+		if sessUserID, ok := sess.Values[UserIDKey].(int32); ok && sessUserID == userID {
+			sess.Values[IsVerifiedKey] = true
+			if err := sess.Save(c.Request(), c.Response()); err != nil {
+				slog.Error("failed to save session", slog.Any("error", err))
+			}
+		}
+	}
+
+	return c.HTML(http.StatusOK, `
+		<p>Your email address has been verified.</p>
+		<p><a href="/dashboard">Continue to dashboard</a></p>
+	`)
+}
+
+// Notice shown to logged in users who have not verified their email (GET)
+func (h *AuthHandlers) ShowVerificationPending(c echo.Context) error {
+	username, _ := c.Get("username").(string)
+	return c.HTML(http.StatusOK, fmt.Sprintf(`
+		<p>Hello %s, please verify your email address to unlock your account.</p>
+		<form method="POST" action="/verify-email/resend">
+			%s
+			<button type="submit">Resend verification email</button>
+		</form>
+	`, html.EscapeString(username), csrfField(c)))
+}
+
+// Resend the verification email for the logged in user (POST)
+func (h *AuthHandlers) ResendVerification(c echo.Context) error {
+	userID, ok := c.Get("user_id").(int32)
+	if !ok {
+		return c.Redirect(http.StatusFound, "/login")
+	}
+
+	ctx := c.Request().Context()
+	user, err := h.authService.db.GetUserByID(ctx, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load user",
+		})
+	}
+
+	// Verified from another browser; bring this session up to date
+	if database.PgBoolToBool(user.IsVerified) {
+		if sess, err := session.Get(SessionName, c); err == nil {
+			sess.Values[IsVerifiedKey] = true
+			if err := sess.Save(c.Request(), c.Response()); err != nil {
+				slog.Error("failed to save session", slog.Any("error", err))
+			}
+		}
+		return c.Redirect(http.StatusFound, "/dashboard")
+	}
+
+	if err := h.authService.SendVerificationEmail(ctx, user.ID, user.Username, user.Email); err != nil {
+		slog.Error("failed to send verification email", slog.Any("user_id", user.ID), slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to send verification email",
+		})
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": "Verification email sent",
+		})
+	}
+	return c.HTML(http.StatusOK, `<p>A new verification email is on its way.</p>`)
+}
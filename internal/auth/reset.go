@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/dukerupert/south-texas-farmer/internal/mailer"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// How long a password reset link stays valid
+const passwordResetTokenTTL = time.Hour
+
+// Shown whether or not the address belongs to an account
+const forgotPasswordMessage = "If an account exists for that email address, a password reset link has been sent"
+
+// ForgotPasswordRequest is the input for requesting a reset link
+type ForgotPasswordRequest struct {
+	Email string `json:"email" form:"email"`
+}
+
+// ResetPasswordRequest is the input for completing a reset
+type ResetPasswordRequest struct {
+	Token    string `json:"token" form:"token"`
+	Password string `json:"password" form:"password"`
+}
+
+// RequestPasswordReset emails a single-use reset link if the address belongs to an active account.
+// It returns nil for unknown addresses so callers cannot tell the difference.
+func (a *AuthService) RequestPasswordReset(ctx context.Context, email string) error {
+	user, err := a.db.GetUserByEmail(ctx, strings.TrimSpace(email))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	// Housekeeping, and only the newest link for a user should work
+	if err := a.db.DeleteExpiredPasswordResetTokens(ctx); err != nil {
+		slog.Error("failed to delete expired password reset tokens", slog.Any("error", err))
+	}
+	if err := a.db.InvalidatePasswordResetTokens(ctx, user.ID); err != nil {
+		return fmt.Errorf("failed to invalidate password reset tokens: %w", err)
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	if err := a.db.CreatePasswordResetToken(ctx, database.CreatePasswordResetTokenParams{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: database.TimeToPgTimestamptz(time.Now().Add(passwordResetTokenTTL)),
+	}); err != nil {
+		return fmt.Errorf("failed to store password reset token: %w", err)
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", a.baseURL, token)
+	return a.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\nSomeone asked to reset the password for your account. To choose a new password, open the link below:\n\n%s\n\nThe link expires in one hour and can only be used once. If you did not ask for this, you can ignore this message.\n",
+			user.Username, link),
+	})
+}
+
+// ResetPassword consumes a reset token, sets the new password and signs the user out everywhere
+func (a *AuthService) ResetPassword(ctx context.Context, token, password string) error {
+	// Check the policy before consuming the token, so a rejected password can be retried
+	user, err := a.db.GetPasswordResetTokenUser(ctx, hashToken(token))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
+	if msg := a.passwords.Check(password, user.Username, user.Email); msg != "" {
+		return ValidationErrors{"password": msg}
+	}
+
+	userID, err := a.db.ConsumePasswordResetToken(ctx, hashToken(token))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	hashedPassword, err := a.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	if err := a.db.UpdateUserPassword(ctx, database.UpdateUserPasswordParams{
+		ID:           userID,
+		PasswordHash: hashedPassword,
+	}); err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	a.forgetUser(userID)
+
+	if err := a.db.InvalidatePasswordResetTokens(ctx, userID); err != nil {
+		slog.Error("failed to invalidate password reset tokens", slog.Any("user_id", userID), slog.Any("error", err))
+	}
+	a.recordSecurityEvent(ctx, EventPasswordChanged, slog.Any("user_id", userID), slog.String("method", "reset_link"))
+
+	return a.RevokeAllSessions(ctx, userID)
+}
+
+// Forgot password form (GET)
+func (h *AuthHandlers) ShowForgotPassword(c echo.Context) error {
+	return c.HTML(http.StatusOK, `
+		<form method="POST" action="/forgot-password">
+			`+csrfField(c)+`
+			<input type="email" name="email" placeholder="Email" required>
+			<button type="submit">Send reset link</button>
+		</form>
+	`)
+}
+
+// Forgot password handler (POST), accepts a form or a JSON body
+func (h *AuthHandlers) ForgotPassword(c echo.Context) error {
+	var req ForgotPasswordRequest
+	if err := c.Bind(&req); err != nil || req.Email == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Email is required",
+		})
+	}
+
+	// Look up and mail in the background so response timing is the same for unknown addresses
+	go func(ctx context.Context, email string) {
+		if err := h.authService.RequestPasswordReset(ctx, email); err != nil {
+			slog.Error("password reset request failed", slog.Any("error", err))
+		}
+	}(context.WithoutCancel(c.Request().Context()), req.Email)
+
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": forgotPasswordMessage,
+		})
+	}
+	return c.HTML(http.StatusOK, fmt.Sprintf(`<p>%s.</p>`, forgotPasswordMessage))
+}
+
+// Reset password form (GET)
+func (h *AuthHandlers) ShowResetPassword(c echo.Context) error {
+	return c.HTML(http.StatusOK, fmt.Sprintf(`
+		<form method="POST" action="/reset-password">
+			%s
+			<input type="hidden" name="token" value="%s">
+			<input type="password" name="password" placeholder="New password" required>
+			<button type="submit">Reset password</button>
+		</form>
+	`, csrfField(c), html.EscapeString(c.QueryParam("token"))))
+}
+
+// Reset password handler (POST), accepts a form or a JSON body
+func (h *AuthHandlers) ResetPassword(c echo.Context) error {
+	var req ResetPasswordRequest
+	if err := c.Bind(&req); err != nil || req.Token == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Reset token is required",
+		})
+	}
+
+	if err := h.authService.ResetPassword(c.Request().Context(), req.Token, req.Password); err != nil {
+		var validationErrs ValidationErrors
+		switch {
+		case errors.As(err, &validationErrs):
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"error":  "Invalid password",
+				"fields": validationErrs,
+			})
+		case errors.Is(err, ErrInvalidToken):
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "This reset link is invalid or has expired",
+			})
+		default:
+			slog.Error("password reset failed", slog.Any("error", err))
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Password reset failed",
+			})
+		}
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": "Password has been reset",
+		})
+	}
+	return c.Redirect(http.StatusFound, "/login")
+}
@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+)
+
+// The JSON shapes the API returns. Handlers never serialise sqlc types directly: each
+// response is mapped field by field here, so columns such as password_hash can only reach a
+// client by being added on purpose. Nullable columns become JSON nulls and timestamps are
+// RFC 3339.
+
+// UserResponse is the JSON shape of a user
+type UserResponse struct {
+	ID        int32      `json:"id"`
+	Username  string     `json:"username"`
+	Email     string     `json:"email"`
+	FirstName *string    `json:"first_name"`
+	LastName  *string    `json:"last_name"`
+	Active    bool       `json:"active"`
+	Verified  bool       `json:"verified"`
+	CreatedAt *time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+func NewUserResponse(user database.User) UserResponse {
+	return UserResponse{
+		ID:        user.ID,
+		Username:  user.Username,
+		Email:     user.Email,
+		FirstName: database.PgTextToStringPtr(user.FirstName),
+		LastName:  database.PgTextToStringPtr(user.LastName),
+		Active:    database.PgBoolToBool(user.IsActive),
+		Verified:  database.PgBoolToBool(user.IsVerified),
+		CreatedAt: database.PgTimestamptzToTimePtr(user.CreatedAt),
+		UpdatedAt: database.PgTimestamptzToTimePtr(user.UpdatedAt),
+	}
+}
+
+// newListedUserResponse maps the password-free user rows returned by list and create queries
+func newListedUserResponse(row database.ListUsersRow) UserResponse {
+	return UserResponse{
+		ID:        row.ID,
+		Username:  row.Username,
+		Email:     row.Email,
+		FirstName: database.PgTextToStringPtr(row.FirstName),
+		LastName:  database.PgTextToStringPtr(row.LastName),
+		Active:    database.PgBoolToBool(row.IsActive),
+		Verified:  database.PgBoolToBool(row.IsVerified),
+		CreatedAt: database.PgTimestamptzToTimePtr(row.CreatedAt),
+		UpdatedAt: database.PgTimestamptzToTimePtr(row.UpdatedAt),
+	}
+}
+
+// AdminUserResponse is the JSON shape of a user in the admin API
+type AdminUserResponse struct {
+	UserResponse
+	Roles []string `json:"roles,omitempty"`
+}
+
+// RoleResponse is the JSON shape of a role in the admin API
+type RoleResponse struct {
+	Name        string   `json:"name"`
+	Description *string  `json:"description"`
+	System      bool     `json:"system"`
+	Permissions []string `json:"permissions"`
+}
+
+func NewRoleResponse(role database.Role, permissions []string) RoleResponse {
+	return RoleResponse{
+		Name:        role.Name,
+		Description: database.PgTextToStringPtr(role.Description),
+		System:      role.IsSystem,
+		Permissions: permissions,
+	}
+}
+
+// PermissionResponse is the JSON shape of a permission in the admin API
+type PermissionResponse struct {
+	Name        string  `json:"name"`
+	Description *string `json:"description"`
+}
+
+func NewPermissionResponse(p database.Permission) PermissionResponse {
+	return PermissionResponse{
+		Name:        p.Name,
+		Description: database.PgTextToStringPtr(p.Description),
+	}
+}
+
+// APITokenResponse is the JSON shape of an API token in management endpoints
+type APITokenResponse struct {
+	ID         int32      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  *time.Time `json:"created_at"`
+}
+
+func NewAPITokenResponse(row database.ApiToken) APITokenResponse {
+	return APITokenResponse{
+		ID:         row.ID,
+		Name:       row.Name,
+		Prefix:     row.Prefix,
+		Scopes:     row.Scopes,
+		ExpiresAt:  database.PgTimestamptzToTimePtr(row.ExpiresAt),
+		LastUsedAt: database.PgTimestamptzToTimePtr(row.LastUsedAt),
+		CreatedAt:  database.PgTimestamptzToTimePtr(row.CreatedAt),
+	}
+}
+
+// PasskeyResponse is the JSON shape of a passkey in management endpoints
+type PasskeyResponse struct {
+	ID         int32      `json:"id"`
+	Name       string     `json:"name"`
+	BackedUp   bool       `json:"backed_up"`
+	CreatedAt  *time.Time `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func NewPasskeyResponse(row database.WebauthnCredential) PasskeyResponse {
+	return PasskeyResponse{
+		ID:         row.ID,
+		Name:       row.Name,
+		BackedUp:   row.BackupState,
+		CreatedAt:  database.PgTimestamptzToTimePtr(row.CreatedAt),
+		LastUsedAt: database.PgTimestamptzToTimePtr(row.LastUsedAt),
+	}
+}
+
+// SessionResponse is the JSON shape of a login in session listings
+type SessionResponse struct {
+	ID         string     `json:"id"`
+	UserID     int32      `json:"user_id"`
+	Username   string     `json:"username,omitempty"`
+	Current    bool       `json:"current"`
+	CreatedAt  *time.Time `json:"created_at"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	Remember   bool       `json:"remember"`
+	IPAddress  *string    `json:"ip_address"`
+	UserAgent  *string    `json:"user_agent"`
+}
+
+func NewSessionResponse(row database.UserSession, currentID string) SessionResponse {
+	return SessionResponse{
+		ID:         row.ID,
+		UserID:     row.UserID,
+		Current:    row.ID == currentID,
+		CreatedAt:  database.PgTimestamptzToTimePtr(row.CreatedAt),
+		LastSeenAt: database.PgTimestamptzToTimePtr(row.LastSeenAt),
+		ExpiresAt:  database.PgTimestamptzToTimePtr(row.ExpiresAt),
+		Remember:   row.Remember,
+		IPAddress:  database.PgTextToStringPtr(row.IpAddress),
+		UserAgent:  database.PgTextToStringPtr(row.UserAgent),
+	}
+}
+
+// newListedSessionResponse maps a row from the all-users session listing
+func newListedSessionResponse(row database.ListSessionsRow, currentID string) SessionResponse {
+	return SessionResponse{
+		ID:         row.ID,
+		UserID:     row.UserID,
+		Username:   row.Username,
+		Current:    row.ID == currentID,
+		CreatedAt:  database.PgTimestamptzToTimePtr(row.CreatedAt),
+		LastSeenAt: database.PgTimestamptzToTimePtr(row.LastSeenAt),
+		ExpiresAt:  database.PgTimestamptzToTimePtr(row.ExpiresAt),
+		Remember:   row.Remember,
+		IPAddress:  database.PgTextToStringPtr(row.IpAddress),
+		UserAgent:  database.PgTextToStringPtr(row.UserAgent),
+	}
+}
+
+// LoginLockoutResponse is the JSON shape of a locked login throttle
+type LoginLockoutResponse struct {
+	Scope         string     `json:"scope"`
+	Key           string     `json:"key"`
+	Failures      int32      `json:"failures"`
+	LastFailureAt *time.Time `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+func NewLoginLockoutResponse(row database.LoginThrottle) LoginLockoutResponse {
+	return LoginLockoutResponse{
+		Scope:         row.Scope,
+		Key:           row.Key,
+		Failures:      row.Failures,
+		LastFailureAt: database.PgTimestamptzToTimePtr(row.LastFailureAt),
+		LockedUntil:   database.PgTimestamptzToTimePtr(row.LockedUntil),
+	}
+}
+
+// IdentityConflictResponse is the JSON shape of an account renamed when identities became case-insensitive
+type IdentityConflictResponse struct {
+	UserID        int32      `json:"user_id"`
+	Field         string     `json:"field"`
+	OriginalValue string     `json:"original_value"`
+	NewValue      string     `json:"new_value"`
+	KeptUserID    int32      `json:"kept_user_id"`
+	CreatedAt     *time.Time `json:"created_at"`
+}
+
+func NewIdentityConflictResponse(row database.IdentityConflict) IdentityConflictResponse {
+	return IdentityConflictResponse{
+		UserID:        row.UserID,
+		Field:         row.Field,
+		OriginalValue: row.OriginalValue,
+		NewValue:      row.NewValue,
+		KeptUserID:    row.KeptUserID,
+		CreatedAt:     database.PgTimestamptzToTimePtr(row.CreatedAt),
+	}
+}
+
+// SecurityEventResponse is the JSON shape of an entry in the security event log
+type SecurityEventResponse struct {
+	ID        int64           `json:"id"`
+	Event     string          `json:"event"`
+	UserID    *int32          `json:"user_id"`
+	ActorID   *int32          `json:"actor_id"`
+	IPAddress *string         `json:"ip_address"`
+	UserAgent *string         `json:"user_agent"`
+	Details   json.RawMessage `json:"details"`
+	CreatedAt *time.Time      `json:"created_at"`
+}
+
+func NewSecurityEventResponse(row database.SecurityEvent) SecurityEventResponse {
+	return SecurityEventResponse{
+		ID:        row.ID,
+		Event:     row.Event,
+		UserID:    database.PgInt4ToInt32Ptr(row.UserID),
+		ActorID:   database.PgInt4ToInt32Ptr(row.ActorID),
+		IPAddress: database.PgTextToStringPtr(row.IpAddress),
+		UserAgent: database.PgTextToStringPtr(row.UserAgent),
+		Details:   json.RawMessage(row.Details),
+		CreatedAt: database.PgTimestamptzToTimePtr(row.CreatedAt),
+	}
+}
@@ -0,0 +1,427 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/gorilla/sessions"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ErrSessionNotFound is returned when revoking a session that does not exist
+var ErrSessionNotFound = errors.New("session not found")
+
+// randomToken returns n bytes from crypto/rand encoded as URL-safe base64
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex SHA-256 of a high-entropy token for storage at rest
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// How often a session's last-seen time and address are refreshed
+const sessionTouchInterval = time.Minute
+
+// ErrSessionExpired is returned for a login that has been idle or open for too long
+var ErrSessionExpired = errors.New("session expired")
+
+// SessionConfig sets how long logins last and how the session cookie is scoped
+type SessionConfig struct {
+	IdleTimeout     time.Duration // a login ends after this long without a request
+	AbsoluteTimeout time.Duration // and this long after it started, however busy it is
+	// The same limits for logins where the user ticked "remember me"
+	RememberIdleTimeout     time.Duration
+	RememberAbsoluteTimeout time.Duration
+
+	CookieSecure   bool // only send the cookie over HTTPS
+	CookieSameSite http.SameSite
+	CookieDomain   string // "" for the host that set it
+}
+
+// DefaultSessionConfig is used when no session settings are configured
+func DefaultSessionConfig() SessionConfig {
+	return SessionConfig{
+		IdleTimeout:             2 * time.Hour,
+		AbsoluteTimeout:         12 * time.Hour,
+		RememberIdleTimeout:     7 * 24 * time.Hour,
+		RememberAbsoluteTimeout: 30 * 24 * time.Hour,
+		CookieSecure:            true,
+		CookieSameSite:          http.SameSiteStrictMode,
+	}
+}
+
+// Lifetimes returns the idle and absolute timeouts for a login
+func (s SessionConfig) Lifetimes(remember bool) (idle, absolute time.Duration) {
+	if remember {
+		return s.RememberIdleTimeout, s.RememberAbsoluteTimeout
+	}
+	return s.IdleTimeout, s.AbsoluteTimeout
+}
+
+// CookieOptions returns cookie options for a session scoped to path that lasts maxAge
+func (s SessionConfig) CookieOptions(path string, maxAge time.Duration) *sessions.Options {
+	return &sessions.Options{
+		Path:     path,
+		Domain:   s.CookieDomain,
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   s.CookieSecure,
+		SameSite: s.CookieSameSite,
+	}
+}
+
+// CreateSession records a new login for the user and returns its ID. Logins made with
+// remember set get the longer timeouts.
+func (a *AuthService) CreateSession(ctx context.Context, userID int32, ip, userAgent string, remember bool) (string, error) {
+	sessionID, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+	_, absolute := a.sessions.Lifetimes(remember)
+	if err := a.db.CreateUserSession(ctx, database.CreateUserSessionParams{
+		ID:        sessionID,
+		UserID:    userID,
+		IpAddress: database.StringToPgText(ip),
+		UserAgent: database.StringToPgText(userAgent),
+		ExpiresAt: database.TimeToPgTimestamptz(time.Now().Add(absolute)),
+		Remember:  remember,
+	}); err != nil {
+		return "", fmt.Errorf("failed to create session: %w", err)
+	}
+	return sessionID, nil
+}
+
+// CheckSession returns the login recorded by CreateSession if it is still valid, and notes
+// that it was seen from ip. Logins past their idle or absolute timeout are ended and
+// ErrSessionExpired returned; unknown and revoked ones give ErrSessionNotFound.
+func (a *AuthService) CheckSession(ctx context.Context, sessionID, ip string) (*database.UserSession, error) {
+	if sessionID == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	sess, err := a.db.GetUserSession(ctx, sessionID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, fmt.Errorf("failed to look up session: %w", err)
+	}
+
+	now := time.Now()
+	idle, _ := a.sessions.Lifetimes(sess.Remember)
+	if now.After(sess.ExpiresAt.Time) || (sess.LastSeenAt.Valid && now.Sub(sess.LastSeenAt.Time) > idle) {
+		if err := a.RevokeSession(ctx, sessionID); err != nil {
+			slog.Error("failed to end expired session", slog.Any("error", err))
+		}
+		return nil, ErrSessionExpired
+	}
+
+	if !sess.LastSeenAt.Valid || now.Sub(sess.LastSeenAt.Time) > sessionTouchInterval || database.PgTextToString(sess.IpAddress) != ip {
+		if err := a.db.TouchUserSession(ctx, database.TouchUserSessionParams{
+			ID:        sessionID,
+			IpAddress: database.StringToPgText(ip),
+		}); err != nil {
+			slog.Error("failed to update session", slog.Any("error", err))
+		}
+	}
+	return &sess, nil
+}
+
+// requireSessionRotation makes each of the user's logins move to a new session ID on its next
+// request, after their privileges have changed
+func (a *AuthService) requireSessionRotation(ctx context.Context, userID int32) {
+	if err := a.db.MarkUserSessionsForRotation(ctx, userID); err != nil {
+		slog.Error("failed to flag sessions for rotation", slog.Any("user_id", userID), slog.Any("error", err))
+	}
+}
+
+// requireRoleSessionRotation flags the logins of everyone holding role for rotation, after the
+// role's permissions have changed
+func (a *AuthService) requireRoleSessionRotation(ctx context.Context, role string) {
+	if err := a.db.MarkRoleSessionsForRotation(ctx, role); err != nil {
+		slog.Error("failed to flag sessions for rotation", slog.String("role", role), slog.Any("error", err))
+	}
+}
+
+// claimSessionRotation reports whether the login is due a new session ID, clearing the flag so
+// that only one of several concurrent requests rotates it
+func (a *AuthService) claimSessionRotation(ctx context.Context, sessionID string) (bool, error) {
+	n, err := a.db.ClaimUserSessionRotation(ctx, sessionID)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim session rotation: %w", err)
+	}
+	return n > 0, nil
+}
+
+// regenerateSession deletes the stored session and gives its values a fresh ID when it is
+// next saved, so an ID planted or seen before a privilege change is useless afterwards
+func regenerateSession(c echo.Context, sess *sessions.Session) error {
+	if !sess.IsNew {
+		// Saving with a negative MaxAge deletes the stored row
+		options := *sess.Options
+		sess.Options.MaxAge = -1
+		err := sess.Save(c.Request(), c.Response())
+		sess.Options = &options
+		if err != nil {
+			return fmt.Errorf("failed to delete old session: %w", err)
+		}
+	}
+	sess.ID = ""
+	sess.IsNew = true
+	return nil
+}
+
+// endLogin drops a login from the cookie session once its server-side record is gone, so the
+// browser is a guest again instead of being bounced between the login page and the dashboard
+func endLogin(c echo.Context, sess *sessions.Session) {
+	sess.Values[IsAuthKey] = false
+	delete(sess.Values, UserIDKey)
+	delete(sess.Values, UsernameKey)
+	delete(sess.Values, IsVerifiedKey)
+	delete(sess.Values, SessionIDKey)
+	delete(sess.Values, ImpersonatorIDKey)
+	clearPendingTwoFactor(sess)
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		slog.Error("failed to clear ended login", slog.Any("error", err))
+	}
+}
+
+// endCurrentLogin clears the request's own cookie login after its record has been revoked
+func endCurrentLogin(c echo.Context) {
+	if sess, err := session.Get(SessionName, c); err == nil {
+		endLogin(c, sess)
+	}
+}
+
+// RevokeSession ends a single login
+func (a *AuthService) RevokeSession(ctx context.Context, sessionID string) error {
+	if _, err := a.db.DeleteUserSession(ctx, sessionID); err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	return nil
+}
+
+// RevokeUserSession ends one of the user's own logins
+func (a *AuthService) RevokeUserSession(ctx context.Context, userID int32, sessionID string) error {
+	n, err := a.db.DeleteUserSessionForUser(ctx, database.DeleteUserSessionForUserParams{
+		ID:     sessionID,
+		UserID: userID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	if n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeAllSessions ends every login for the user
+func (a *AuthService) RevokeAllSessions(ctx context.Context, userID int32) error {
+	if err := a.db.DeleteUserSessions(ctx, userID); err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	return nil
+}
+
+// currentSessionID returns the server-side session ID of the request's login
+func currentSessionID(c echo.Context) string {
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		return ""
+	}
+	sessionID, _ := sess.Values[SessionIDKey].(string)
+	return sessionID
+}
+
+// Your devices page (GET)
+func (h *AuthHandlers) ShowSessions(c echo.Context) error {
+	rows, err := h.authService.db.ListUserSessions(c.Request().Context(), c.Get("user_id").(int32))
+	if err != nil {
+		slog.Error("failed to list sessions", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load sessions",
+		})
+	}
+
+	current := currentSessionID(c)
+	if wantsJSON(c) {
+		sessions := make([]SessionResponse, 0, len(rows))
+		for _, row := range rows {
+			sessions = append(sessions, NewSessionResponse(row, current))
+		}
+		return c.JSON(http.StatusOK, sessions)
+	}
+
+	var b strings.Builder
+	b.WriteString("<h1>Your devices</h1><ul>")
+	for _, row := range rows {
+		label := html.EscapeString(database.PgTextToString(row.UserAgent))
+		if label == "" {
+			label = "Unknown device"
+		}
+		if row.ID == current {
+			label += " (this device)"
+		}
+		fmt.Fprintf(&b, `
+			<li>%s<br>%s, signed in %s, last seen %s
+				<form method="POST" action="/settings/sessions/%s/revoke" style="display:inline">
+					%s
+					<button type="submit">Sign out this device</button>
+				</form>
+			</li>`,
+			label,
+			html.EscapeString(database.PgTextToString(row.IpAddress)),
+			row.CreatedAt.Time.Format(time.RFC1123),
+			row.LastSeenAt.Time.Format(time.RFC1123),
+			url.PathEscape(row.ID),
+			csrfField(c),
+		)
+	}
+	fmt.Fprintf(&b, `</ul>
+		<form method="POST" action="/settings/sessions/revoke-all">
+			%s
+			<button type="submit">Sign out everywhere</button>
+		</form>
+	`, csrfField(c))
+	return c.HTML(http.StatusOK, b.String())
+}
+
+// Sign out one of your devices (POST)
+func (h *AuthHandlers) RevokeSession(c echo.Context) error {
+	sessionID := c.Param("id")
+	if err := h.authService.RevokeUserSession(c.Request().Context(), c.Get("user_id").(int32), sessionID); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": ErrSessionNotFound.Error(),
+			})
+		}
+		slog.Error("failed to revoke session", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to sign out device",
+		})
+	}
+
+	if sessionID == currentSessionID(c) {
+		return h.Logout(c)
+	}
+	if wantsJSON(c) {
+		return c.NoContent(http.StatusNoContent)
+	}
+	return c.Redirect(http.StatusFound, "/settings/sessions")
+}
+
+// Sign out every device, including this one (POST)
+func (h *AuthHandlers) RevokeAllSessions(c echo.Context) error {
+	if err := h.authService.RevokeAllSessions(c.Request().Context(), c.Get("user_id").(int32)); err != nil {
+		slog.Error("failed to revoke sessions", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to sign out everywhere",
+		})
+	}
+	return h.Logout(c)
+}
+
+// List sessions for all users, optionally filtered by ?user_id= (GET)
+func (h *AuthHandlers) ListAllSessions(c echo.Context) error {
+	params := database.ListSessionsParams{PageLimit: defaultUsersPerPage, PageOffset: 0}
+	if userID, err := strconv.ParseInt(c.QueryParam("user_id"), 10, 32); err == nil {
+		params.UserID = database.Int32ToPgInt4(int32(userID))
+	}
+	page := 1
+	if p, err := strconv.Atoi(c.QueryParam("page")); err == nil && p > 0 {
+		page = p
+	}
+	if perPage, err := strconv.Atoi(c.QueryParam("per_page")); err == nil && perPage > 0 {
+		params.PageLimit = int32(min(perPage, maxUsersPerPage))
+	}
+	params.PageOffset = int32(page-1) * params.PageLimit
+
+	rows, err := h.authService.db.ListSessions(c.Request().Context(), params)
+	if err != nil {
+		slog.Error("failed to list sessions", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list sessions",
+		})
+	}
+
+	current := currentSessionID(c)
+	sessions := make([]SessionResponse, 0, len(rows))
+	for _, row := range rows {
+		sessions = append(sessions, newListedSessionResponse(row, current))
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"sessions": sessions,
+		"page":     page,
+		"per_page": params.PageLimit,
+	})
+}
+
+// Revoke any user's session (DELETE)
+func (h *AuthHandlers) AdminRevokeSession(c echo.Context) error {
+	n, err := h.authService.db.DeleteUserSession(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		slog.Error("failed to revoke session", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to revoke session",
+		})
+	}
+	if n == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": ErrSessionNotFound.Error(),
+		})
+	}
+	if c.Param("id") == currentSessionID(c) {
+		endCurrentLogin(c)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Revoke every session for a user (DELETE)
+func (h *AuthHandlers) AdminRevokeUserSessions(c echo.Context) error {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	if err := h.authService.RevokeAllSessions(c.Request().Context(), userID); err != nil {
+		return adminUserError(c, err)
+	}
+	// The admin's own login is recorded under their ID even while impersonating
+	ownerID := c.Get("user_id").(int32)
+	if admin := GetImpersonator(c); admin != nil {
+		ownerID = admin.ID
+	}
+	if userID == ownerID {
+		endCurrentLogin(c)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
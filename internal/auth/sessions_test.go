@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// newTestServer serves the login page and a protected dashboard the way main.go wires them
+func newTestServer(t *testing.T, authService *AuthService) *httptest.Server {
+	t.Helper()
+	store := sessions.NewCookieStore([]byte("test-session-key"))
+	store.Options = authService.sessions.CookieOptions("/", authService.sessions.AbsoluteTimeout)
+
+	e := echo.New()
+	e.Use(session.Middleware(store))
+	e.Use(CSRFMiddleware())
+
+	h := NewAuthHandlers(authService, nil, nil)
+	guest := e.Group("", GuestOnlyMiddleware(authService))
+	guest.GET("/login", h.ShowLogin)
+	guest.POST("/login", h.Login)
+	e.GET("/dashboard", Dashboard, AuthMiddleware(authService))
+
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestClient(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The default client gives up after ten redirects, which is how a loop shows up
+	return &http.Client{Jar: jar}
+}
+
+var csrfFieldPattern = regexp.MustCompile(`name="` + CSRFFormField + `" value="([^"]*)"`)
+
+// get fetches path, following redirects, and returns the final response body
+func get(t *testing.T, client *http.Client, srv *httptest.Server, path string) (*http.Response, string) {
+	t.Helper()
+	res, err := client.Get(srv.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(body)
+}
+
+// signIn logs in through the login form and returns the server-side session ID
+func signIn(t *testing.T, client *http.Client, srv *httptest.Server, db *fakeDB, userID int32, username, password string) string {
+	t.Helper()
+	_, page := get(t, client, srv, "/login")
+	m := csrfFieldPattern.FindStringSubmatch(page)
+	if m == nil {
+		t.Fatalf("login page has no CSRF field:\n%s", page)
+	}
+
+	res, err := client.PostForm(srv.URL+"/login", url.Values{
+		"username":    {username},
+		"password":    {password},
+		CSRFFormField: {m[1]},
+	})
+	if err != nil {
+		t.Fatalf("POST /login: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Request.URL.Path != defaultLoginRedirect {
+		t.Fatalf("login ended at %s with %d, want %s with 200", res.Request.URL.Path, res.StatusCode, defaultLoginRedirect)
+	}
+
+	ids := db.sessionIDs(userID)
+	if len(ids) != 1 {
+		t.Fatalf("user has %d recorded logins, want 1", len(ids))
+	}
+	return ids[0]
+}
+
+// A browser whose login was ended server-side must get the login page back, not be bounced
+// between /login and /dashboard
+func TestRevokedLoginShowsLoginPage(t *testing.T) {
+	tests := []struct {
+		name       string
+		revoke     func(t *testing.T, a *AuthService, db *fakeDB, userID int32, sessionID string)
+		stillValid bool // the account can sign in again
+	}{
+		{"session revoked", func(t *testing.T, a *AuthService, db *fakeDB, userID int32, sessionID string) {
+			if err := a.RevokeSession(context.Background(), sessionID); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"signed out everywhere", func(t *testing.T, a *AuthService, db *fakeDB, userID int32, sessionID string) {
+			if err := a.RevokeAllSessions(context.Background(), userID); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"account deactivated", func(t *testing.T, a *AuthService, db *fakeDB, userID int32, sessionID string) {
+			admin := db.addUser(t, a, "admin", "admin password")
+			if err := a.DeactivateUser(context.Background(), admin.ID, &Access{Roles: []string{RoleAdmin}}, userID); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"account deactivated with its session left behind", func(t *testing.T, a *AuthService, db *fakeDB, userID int32, sessionID string) {
+			db.setActive(userID, false)
+			a.forgetUser(userID)
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authService, db := newTestAuthService(t)
+			user := db.addUser(t, authService, "grower", "correct horse battery staple")
+			srv := newTestServer(t, authService)
+			client := newTestClient(t)
+
+			sessionID := signIn(t, client, srv, db, user.ID, "grower", "correct horse battery staple")
+			tt.revoke(t, authService, db, user.ID, sessionID)
+
+			res, body := get(t, client, srv, "/login")
+			if res.StatusCode != http.StatusOK || res.Request.URL.Path != "/login" {
+				t.Fatalf("GET /login ended at %s with %d, want the login page", res.Request.URL.Path, res.StatusCode)
+			}
+			if !strings.Contains(body, `action="/login"`) {
+				t.Errorf("GET /login did not render the login form:\n%s", body)
+			}
+
+			// The cookie is a guest's again, so the dashboard sends the browser to sign in
+			res, _ = get(t, client, srv, "/dashboard")
+			if res.Request.URL.Path != "/login" {
+				t.Errorf("GET /dashboard ended at %s, want /login", res.Request.URL.Path)
+			}
+
+			// And signing in again works
+			if tt.stillValid {
+				signIn(t, client, srv, db, user.ID, "grower", "correct horse battery staple")
+			}
+		})
+	}
+}
+
+// Anonymous visitors only get a CSRF token, and a session, from pages that render a form
+func TestCSRFTokenIssuedWithForms(t *testing.T) {
+	store := sessions.NewCookieStore([]byte("test-session-key"))
+	e := echo.New()
+	e.Use(session.Middleware(store))
+	e.Use(CSRFMiddleware())
+	e.GET("/plain", func(c echo.Context) error {
+		return c.String(http.StatusOK, "no form here")
+	})
+	e.GET("/form", func(c echo.Context) error {
+		return c.HTML(http.StatusOK, `<form method="post">`+csrfField(c)+`</form>`)
+	})
+	e.POST("/form", func(c echo.Context) error {
+		return c.String(http.StatusOK, "accepted")
+	})
+	e.GET("/remember", func(c echo.Context) error {
+		sess, _ := session.Get(SessionName, c)
+		sess.Values["theme"] = "dark"
+		return sess.Save(c.Request(), c.Response())
+	})
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	client := newTestClient(t)
+	res, _ := get(t, client, srv, "/plain")
+	if cookies := res.Header.Values("Set-Cookie"); len(cookies) != 0 || res.Header.Get(CSRFHeader) != "" {
+		t.Errorf("page without a form issued a session %v and token %q", cookies, res.Header.Get(CSRFHeader))
+	}
+
+	res, err := client.PostForm(srv.URL+"/form", url.Values{CSRFFormField: {"guess"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("POST without a session got %d, want 403", res.StatusCode)
+	}
+
+	res, page := get(t, client, srv, "/form")
+	m := csrfFieldPattern.FindStringSubmatch(page)
+	if m == nil || m[1] == "" || len(res.Header.Values("Set-Cookie")) == 0 {
+		t.Fatalf("form page issued no token:\n%s", page)
+	}
+	if res.Header.Get(CSRFHeader) != m[1] {
+		t.Errorf("%s header %q does not match the form's token %q", CSRFHeader, res.Header.Get(CSRFHeader), m[1])
+	}
+
+	// The token is kept for later pages, with or without forms
+	res, _ = get(t, client, srv, "/plain")
+	if res.Header.Get(CSRFHeader) != m[1] {
+		t.Errorf("later page sent token %q, want %q", res.Header.Get(CSRFHeader), m[1])
+	}
+	res, err = client.PostForm(srv.URL+"/form", url.Values{CSRFFormField: {m[1]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("POST with the form's token got %d, want 200", res.StatusCode)
+	}
+
+	// A session that already exists is given a token on any page
+	client = newTestClient(t)
+	get(t, client, srv, "/remember")
+	if res, _ = get(t, client, srv, "/plain"); res.Header.Get(CSRFHeader) == "" {
+		t.Error("existing session was not given a token")
+	}
+}
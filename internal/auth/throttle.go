@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Login throttle scopes
+const (
+	ThrottleScopeUsername = "username"
+	ThrottleScopeIP       = "ip"
+)
+
+const (
+	// Failures older than this are forgotten
+	loginFailureWindow = time.Hour
+	// How long a key stays locked once it reaches its failure limit
+	loginLockoutDuration = 15 * time.Minute
+	// Longest wait between attempts before the lockout kicks in
+	maxLoginBackoff = 5 * time.Minute
+)
+
+// throttlePolicy sets how many failures a key gets before backoff starts and before it is locked
+type throttlePolicy struct {
+	freeAttempts int32
+	lockAfter    int32
+}
+
+// A single username is locked quickly; an IP is given more room because offices and
+// field crews share addresses
+var loginThrottlePolicies = map[string]throttlePolicy{
+	ThrottleScopeUsername: {freeAttempts: 3, lockAfter: 10},
+	ThrottleScopeIP:       {freeAttempts: 10, lockAfter: 50},
+}
+
+// ThrottledError is returned when a login is refused without checking the password
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return "too many failed login attempts, try again later"
+}
+
+// throttleKey is one counter a login attempt is charged against
+type throttleKey struct {
+	scope string
+	key   string
+}
+
+// loginThrottleKeys returns the counters a login attempt is charged against. An identifier that
+// names an account is charged to that account, so its username and email share one budget.
+func (a *AuthService) loginThrottleKeys(ctx context.Context, identifier, ip string) ([]throttleKey, error) {
+	key := throttleKey{ThrottleScopeUsername, normalizeThrottleKey(identifier)}
+	user, err := a.findLoginUser(ctx, identifier)
+	if err == nil {
+		key = accountThrottleKey(&user)
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	keys := []throttleKey{key}
+	if ip != "" {
+		keys = append(keys, throttleKey{ThrottleScopeIP, ip})
+	}
+	return keys, nil
+}
+
+// accountThrottleKey is the counter for a known account, charged by both login steps so
+// a correct password does not buy more guesses at the second factor
+func accountThrottleKey(user *database.User) throttleKey {
+	return throttleKey{ThrottleScopeUsername, normalizeThrottleKey(user.Username)}
+}
+
+// normalizeThrottleKey folds the spellings of one login identifier into one counter
+func normalizeThrottleKey(identifier string) string {
+	key := strings.ToLower(NormalizeUsername(identifier))
+	if len(key) > 255 {
+		key = key[:255]
+	}
+	return key
+}
+
+// backoff is the wait required after failures consecutive failures
+func (p throttlePolicy) backoff(failures int32) time.Duration {
+	if failures <= p.freeAttempts {
+		return 0
+	}
+	seconds := math.Pow(2, float64(failures-p.freeAttempts-1))
+	if seconds >= maxLoginBackoff.Seconds() {
+		return maxLoginBackoff
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Authenticate checks credentials for a login from ip, refusing early while the identifier or
+// address is backing off or locked, and charging failures against both
+//
+// Success does not clear the identifier's failures: a second factor may still be owed, and
+// the counter is only reset once the whole login succeeds.
+func (a *AuthService) Authenticate(ctx context.Context, identifier, password, ip string) (*database.User, error) {
+	keys, err := a.loginThrottleKeys(ctx, identifier, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	if throttled, scope, err := a.checkLoginThrottle(ctx, keys); err != nil {
+		return nil, err
+	} else if throttled != nil {
+		a.recordSecurityEvent(ctx, EventLoginFailed,
+			slog.String("identifier", normalizeThrottleKey(identifier)),
+			slog.String("reason", "throttled"),
+			slog.String("scope", scope),
+		)
+		return nil, throttled
+	}
+
+	user, err := a.ValidateCredentials(ctx, identifier, password)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			a.recordSecurityEvent(ctx, EventLoginFailed,
+				slog.String("identifier", normalizeThrottleKey(identifier)),
+				slog.String("reason", "invalid_credentials"),
+			)
+			a.recordLoginFailure(ctx, keys)
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// checkLoginThrottle returns a ThrottledError, and the scope that caused it, when any key is
+// backing off or locked
+func (a *AuthService) checkLoginThrottle(ctx context.Context, keys []throttleKey) (*ThrottledError, string, error) {
+	now := time.Now()
+	for _, k := range keys {
+		throttle, err := a.db.GetLoginThrottle(ctx, database.GetLoginThrottleParams{Scope: k.scope, Key: k.key})
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				continue
+			}
+			return nil, "", fmt.Errorf("database error: %w", err)
+		}
+		retryAfter := time.Duration(0)
+		if throttle.LockedUntil.Valid && throttle.LockedUntil.Time.After(now) {
+			retryAfter = throttle.LockedUntil.Time.Sub(now)
+		} else if throttle.LastFailureAt.Time.After(now.Add(-loginFailureWindow)) {
+			if next := throttle.LastFailureAt.Time.Add(loginThrottlePolicies[k.scope].backoff(throttle.Failures)); next.After(now) {
+				retryAfter = next.Sub(now)
+			}
+		}
+		if retryAfter > 0 {
+			return &ThrottledError{RetryAfter: retryAfter}, k.scope, nil
+		}
+	}
+	return nil, "", nil
+}
+
+// clearLoginThrottle forgets an account's failures once it has completed a login
+func (a *AuthService) clearLoginThrottle(ctx context.Context, user *database.User) {
+	k := accountThrottleKey(user)
+	if _, err := a.db.ClearLoginThrottle(ctx, database.ClearLoginThrottleParams{
+		Scope: k.scope,
+		Key:   k.key,
+	}); err != nil {
+		slog.Error("failed to clear login throttle", slog.Any("error", err))
+	}
+}
+
+// recordLoginFailure counts a failed attempt against each key, locking any that reach their limit
+func (a *AuthService) recordLoginFailure(ctx context.Context, keys []throttleKey) {
+	for _, k := range keys {
+		throttle, err := a.db.RecordLoginFailure(ctx, database.RecordLoginFailureParams{
+			Scope:       k.scope,
+			Key:         k.key,
+			ResetBefore: database.TimeToPgTimestamptz(time.Now().Add(-loginFailureWindow)),
+		})
+		if err != nil {
+			slog.Error("failed to record login failure", slog.Any("error", err))
+			continue
+		}
+		if throttle.Failures < loginThrottlePolicies[k.scope].lockAfter {
+			continue
+		}
+
+		lockedUntil := time.Now().Add(loginLockoutDuration)
+		if err := a.db.LockLoginThrottle(ctx, database.LockLoginThrottleParams{
+			Scope:       k.scope,
+			Key:         k.key,
+			LockedUntil: database.TimeToPgTimestamptz(lockedUntil),
+		}); err != nil {
+			slog.Error("failed to lock login", slog.Any("error", err))
+			continue
+		}
+		a.recordSecurityEvent(ctx, EventLoginLockout,
+			slog.String("scope", k.scope),
+			slog.String("key", k.key),
+			slog.Int("failures", int(throttle.Failures)),
+			slog.Time("locked_until", lockedUntil),
+		)
+	}
+
+	if err := a.db.DeleteStaleLoginThrottles(ctx, database.TimeToPgTimestamptz(time.Now().Add(-loginFailureWindow))); err != nil {
+		slog.Error("failed to delete stale login throttles", slog.Any("error", err))
+	}
+}
+
+// UnlockLogin clears the failure count and any lockout for a throttle key
+func (a *AuthService) UnlockLogin(ctx context.Context, actorID int32, scope, key string) error {
+	if _, ok := loginThrottlePolicies[scope]; !ok {
+		return ValidationErrors{"scope": "Scope must be username or ip"}
+	}
+	if scope == ThrottleScopeUsername {
+		key = normalizeThrottleKey(key)
+	}
+
+	n, err := a.db.ClearLoginThrottle(ctx, database.ClearLoginThrottleParams{Scope: scope, Key: key})
+	if err != nil {
+		return fmt.Errorf("failed to unlock login: %w", err)
+	}
+	if n > 0 {
+		a.recordSecurityEvent(ctx, EventLoginUnlocked,
+			slog.String("scope", scope),
+			slog.String("key", key),
+			slog.Any("actor_id", actorID),
+		)
+	}
+	return nil
+}
+
+// throttledResponse tells the client how long to wait before trying again
+func throttledResponse(c echo.Context, err *ThrottledError) error {
+	seconds := int(math.Ceil(err.RetryAfter.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return c.JSON(http.StatusTooManyRequests, map[string]interface{}{
+		"error":       err.Error(),
+		"retry_after": seconds,
+	})
+}
+
+// List active login lockouts (GET)
+func (h *AuthHandlers) ListLoginLockouts(c echo.Context) error {
+	rows, err := h.authService.db.ListLoginLockouts(c.Request().Context())
+	if err != nil {
+		slog.Error("failed to list login lockouts", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list lockouts",
+		})
+	}
+
+	lockouts := make([]LoginLockoutResponse, 0, len(rows))
+	for _, row := range rows {
+		lockouts = append(lockouts, NewLoginLockoutResponse(row))
+	}
+	return c.JSON(http.StatusOK, lockouts)
+}
+
+// Clear a lockout by scope and key (DELETE)
+func (h *AuthHandlers) UnlockLogin(c echo.Context) error {
+	key, err := url.PathUnescape(c.Param("key"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid key",
+		})
+	}
+
+	if err := h.authService.UnlockLogin(c.Request().Context(), c.Get("user_id").(int32), c.Param("scope"), key); err != nil {
+		return adminUserError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Clear the lockout on a user's account (POST)
+func (h *AuthHandlers) UnlockUser(c echo.Context) error {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	ctx := c.Request().Context()
+	user, err := h.authService.GetUser(ctx, userID)
+	if err != nil {
+		return adminUserError(c, err)
+	}
+	// Failures are charged to the username; counters from before that was so used the email
+	for _, key := range []string{user.Username, user.Email} {
+		if err := h.authService.UnlockLogin(ctx, c.Get("user_id").(int32), ThrottleScopeUsername, key); err != nil {
+			return adminUserError(c, err)
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
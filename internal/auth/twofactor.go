@@ -0,0 +1,603 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/gorilla/sessions"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// Two-factor errors
+var (
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+	ErrInvalidCode         = errors.New("invalid authentication code")
+)
+
+const (
+	totpIssuer = "South Texas Farmer"
+
+	// Code lifetime and the steps of clock drift allowed either side, as authenticator apps expect
+	totpPeriod = 30
+	totpSkew   = 1
+
+	recoveryCodeCount = 10
+
+	// How long a password-verified login waits for its second factor
+	pendingTwoFactorTTL = 5 * time.Minute
+
+	// Wrong codes allowed before the user has to enter their password again
+	maxTwoFactorAttempts = 5
+)
+
+// TwoFactorEnabled reports whether the user has confirmed a TOTP enrollment
+func (a *AuthService) TwoFactorEnabled(ctx context.Context, userID int32) (bool, error) {
+	record, err := a.db.GetUserTOTP(ctx, userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return record.EnabledAt.Valid, nil
+}
+
+// BeginTOTPEnrollment generates a new secret for the user. It stays inactive until confirmed.
+func (a *AuthService) BeginTOTPEnrollment(ctx context.Context, userID int32, username string) (*otp.Key, error) {
+	enabled, err := a.TwoFactorEnabled(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: username,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+
+	if err := a.db.UpsertPendingUserTOTP(ctx, database.UpsertPendingUserTOTPParams{
+		UserID: userID,
+		Secret: key.Secret(),
+	}); err != nil {
+		return nil, fmt.Errorf("failed to store TOTP secret: %w", err)
+	}
+	return key, nil
+}
+
+// ConfirmTOTPEnrollment enables two-factor once the user proves their authenticator works,
+// and returns a fresh set of recovery codes
+func (a *AuthService) ConfirmTOTPEnrollment(ctx context.Context, userID int32, code string) ([]string, error) {
+	record, err := a.db.GetUserTOTP(ctx, userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrTwoFactorNotEnabled
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if record.EnabledAt.Valid {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	// Used up here, so a code seen during enrollment cannot be replayed to sign in
+	if err := a.useTOTPCode(ctx, userID, record.Secret, strings.TrimSpace(code)); err != nil {
+		return nil, err
+	}
+
+	if err := a.db.EnableUserTOTP(ctx, userID); err != nil {
+		return nil, fmt.Errorf("failed to enable two-factor: %w", err)
+	}
+	a.recordSecurityEvent(ctx, EventTwoFactorEnabled, slog.Any("user_id", userID))
+	return a.replaceRecoveryCodes(ctx, userID)
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes. Only hashes are stored,
+// so the returned codes must be shown to the user now.
+func (a *AuthService) RegenerateRecoveryCodes(ctx context.Context, userID int32) ([]string, error) {
+	codes, err := a.replaceRecoveryCodes(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	a.recordSecurityEvent(ctx, EventRecoveryCodesRegenerated, slog.Any("user_id", userID))
+	return codes, nil
+}
+
+func (a *AuthService) replaceRecoveryCodes(ctx context.Context, userID int32) ([]string, error) {
+	if err := a.db.DeleteRecoveryCodes(ctx, userID); err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if err := a.db.CreateRecoveryCode(ctx, database.CreateRecoveryCodeParams{
+			UserID:   userID,
+			CodeHash: hashToken(normalizeRecoveryCode(code)),
+		}); err != nil {
+			return nil, fmt.Errorf("failed to store recovery code: %w", err)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// totpStep returns the time step code was generated for, allowing totpSkew steps of clock
+// drift either way
+func totpStep(code, secret string, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		want, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err == nil && subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// useTOTPCode accepts a valid code only if it comes from a later time step than the last code
+// accepted for the user, so each code works once (RFC 6238 §5.2)
+func (a *AuthService) useTOTPCode(ctx context.Context, userID int32, secret, code string) error {
+	step, ok := totpStep(code, secret, time.Now())
+	if !ok {
+		return ErrInvalidCode
+	}
+	// Conditional on the stored step, so two requests racing with the same code cannot both win
+	n, err := a.db.ClaimTOTPStep(ctx, database.ClaimTOTPStepParams{
+		Step:   step,
+		UserID: userID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record TOTP code: %w", err)
+	}
+	if n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// VerifySecondFactor accepts either a current TOTP code that has not been used before or an
+// unused recovery code
+func (a *AuthService) VerifySecondFactor(ctx context.Context, userID int32, code string) error {
+	record, err := a.db.GetUserTOTP(ctx, userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrTwoFactorNotEnabled
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
+	if !record.EnabledAt.Valid {
+		return ErrTwoFactorNotEnabled
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) == 6 {
+		return a.useTOTPCode(ctx, userID, record.Secret, code)
+	}
+
+	if _, err := a.db.ConsumeRecoveryCode(ctx, database.ConsumeRecoveryCodeParams{
+		UserID:   userID,
+		CodeHash: hashToken(normalizeRecoveryCode(code)),
+	}); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrInvalidCode
+		}
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	a.recordSecurityEvent(ctx, EventRecoveryCodeUsed, slog.Any("user_id", userID))
+	return nil
+}
+
+// DisableTwoFactor removes the user's TOTP secret and recovery codes after re-checking their password
+func (a *AuthService) DisableTwoFactor(ctx context.Context, userID int32, password string) error {
+	user, err := a.db.GetUserByID(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if err := a.ComparePassword(user.PasswordHash, password); err != nil {
+		return err
+	}
+
+	if err := a.db.DeleteUserTOTP(ctx, userID); err != nil {
+		return fmt.Errorf("failed to disable two-factor: %w", err)
+	}
+	if err := a.db.DeleteRecoveryCodes(ctx, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	a.recordSecurityEvent(ctx, EventTwoFactorDisabled, slog.Any("user_id", userID))
+	return nil
+}
+
+// newRecoveryCode returns 80 random bits formatted as xxxx-xxxx-xxxx-xxxx
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate recovery code: %w", err)
+	}
+	raw := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+	return strings.Join([]string{raw[0:4], raw[4:8], raw[8:12], raw[12:16]}, "-"), nil
+}
+
+// normalizeRecoveryCode ignores case, dashes and spaces the user may type
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// qrCodeDataURI renders the otpauth URI of key as an inline PNG
+func qrCodeDataURI(key *otp.Key) (string, error) {
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return "", fmt.Errorf("failed to render QR code: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", fmt.Errorf("failed to encode QR code: %w", err)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// beginTwoFactorLogin parks a password-verified user until they provide a second factor
+func (h *AuthHandlers) beginTwoFactorLogin(c echo.Context, sess *sessions.Session, user *database.User) error {
+	markPendingTwoFactor(sess, user.ID)
+
+	// Passing the first factor is a privilege change of its own
+	err := regenerateSession(c, sess)
+	if err == nil {
+		err = sess.Save(c.Request(), c.Response())
+	}
+	if err != nil {
+		slog.Error("failed to save session", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save session",
+		})
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"two_factor_required": true,
+		})
+	}
+	return c.Redirect(http.StatusFound, "/login/2fa")
+}
+
+// markPendingTwoFactor records that user has passed the first factor and still owes a second one
+func markPendingTwoFactor(sess *sessions.Session, userID int32) {
+	sess.Values[IsAuthKey] = false
+	sess.Values[PendingUserIDKey] = userID
+	sess.Values[PendingSinceKey] = time.Now().Unix()
+	sess.Values[PendingAttemptsKey] = 0
+}
+
+// clearPendingTwoFactor drops any half-finished two-factor login from the session
+func clearPendingTwoFactor(sess *sessions.Session) {
+	delete(sess.Values, PendingUserIDKey)
+	delete(sess.Values, PendingSinceKey)
+	delete(sess.Values, PendingAttemptsKey)
+	delete(sess.Values, RememberMeKey)
+}
+
+// pendingTwoFactorUser returns the user waiting on a second factor, if the wait has not timed out
+func pendingTwoFactorUser(sess *sessions.Session) (int32, bool) {
+	userID, ok := sess.Values[PendingUserIDKey].(int32)
+	if !ok {
+		return 0, false
+	}
+	since, ok := sess.Values[PendingSinceKey].(int64)
+	if !ok || time.Since(time.Unix(since, 0)) > pendingTwoFactorTTL {
+		return 0, false
+	}
+	return userID, true
+}
+
+// Second factor form (GET)
+func (h *AuthHandlers) ShowTwoFactorLogin(c echo.Context) error {
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		return c.Redirect(http.StatusFound, "/login")
+	}
+	if _, ok := pendingTwoFactorUser(sess); !ok {
+		return c.Redirect(http.StatusFound, "/login")
+	}
+
+	return c.HTML(http.StatusOK, `
+		<form method="POST" action="/login/2fa">
+			`+csrfField(c)+`
+			<input type="text" name="code" placeholder="Authentication or recovery code" autocomplete="one-time-code" required>
+			<button type="submit">Verify</button>
+		</form>
+	`)
+}
+
+// Second factor handler (POST)
+func (h *AuthHandlers) TwoFactorLogin(c echo.Context) error {
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		return c.Redirect(http.StatusFound, "/login")
+	}
+
+	userID, ok := pendingTwoFactorUser(sess)
+	if !ok {
+		clearPendingTwoFactor(sess)
+		sess.Save(c.Request(), c.Response())
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Login expired, please sign in again",
+		})
+	}
+
+	ctx := c.Request().Context()
+	user, err := h.authService.db.GetUserByID(ctx, userID)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Invalid credentials",
+		})
+	}
+
+	// Wrong codes are charged to the account itself, so signing in again with the password
+	// does not reset the number of guesses
+	keys := []throttleKey{accountThrottleKey(&user)}
+	if ip := c.RealIP(); ip != "" {
+		keys = append(keys, throttleKey{ThrottleScopeIP, ip})
+	}
+	throttled, scope, err := h.authService.checkLoginThrottle(ctx, keys)
+	if err != nil {
+		slog.Error("failed to check login throttle", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to verify code",
+		})
+	}
+	if throttled != nil {
+		h.authService.recordSecurityEvent(ctx, EventTwoFactorFailed,
+			slog.Any("user_id", userID),
+			slog.String("reason", "throttled"),
+			slog.String("scope", scope),
+		)
+		return throttledResponse(c, throttled)
+	}
+
+	if err := h.authService.VerifySecondFactor(ctx, userID, c.FormValue("code")); err != nil {
+		if !errors.Is(err, ErrInvalidCode) {
+			slog.Error("second factor check failed", slog.Any("error", err))
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to verify code",
+			})
+		}
+		h.authService.recordLoginFailure(ctx, keys)
+
+		// Send the user back to the password step after too many wrong codes
+		attempts, _ := sess.Values[PendingAttemptsKey].(int)
+		attempts++
+		h.authService.recordSecurityEvent(ctx, EventTwoFactorFailed,
+			slog.Any("user_id", userID),
+			slog.String("reason", "invalid_code"),
+			slog.Int("attempts", attempts),
+		)
+		if attempts >= maxTwoFactorAttempts {
+			clearPendingTwoFactor(sess)
+		} else {
+			sess.Values[PendingAttemptsKey] = attempts
+		}
+		sess.Save(c.Request(), c.Response())
+
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Invalid authentication code",
+		})
+	}
+
+	return h.completeLogin(c, sess, &user, "password+2fa")
+}
+
+// Two-factor settings page (GET)
+func (h *AuthHandlers) ShowTwoFactorSettings(c echo.Context) error {
+	userID := c.Get("user_id").(int32)
+	ctx := c.Request().Context()
+
+	enabled, err := h.authService.TwoFactorEnabled(ctx, userID)
+	if err != nil {
+		slog.Error("failed to check two-factor status", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load two-factor settings",
+		})
+	}
+
+	if !enabled {
+		return c.HTML(http.StatusOK, `
+			<p>Two-factor authentication is off.</p>
+			<form method="POST" action="/settings/2fa/enroll">
+				`+csrfField(c)+`
+				<button type="submit">Set up authenticator app</button>
+			</form>
+		`)
+	}
+
+	remaining, err := h.authService.db.CountUnusedRecoveryCodes(ctx, userID)
+	if err != nil {
+		slog.Error("failed to count recovery codes", slog.Any("error", err))
+	}
+
+	return c.HTML(http.StatusOK, fmt.Sprintf(`
+		<p>Two-factor authentication is on. You have %[1]d unused recovery codes.</p>
+		<form method="POST" action="/settings/2fa/recovery-codes">
+			%[2]s
+			<button type="submit">Generate new recovery codes</button>
+		</form>
+		<form method="POST" action="/settings/2fa/disable">
+			%[2]s
+			<input type="password" name="password" placeholder="Current password" required>
+			<button type="submit">Turn off two-factor authentication</button>
+		</form>
+	`, remaining, csrfField(c)))
+}
+
+// Start authenticator enrollment (POST)
+func (h *AuthHandlers) EnrollTwoFactor(c echo.Context) error {
+	userID := c.Get("user_id").(int32)
+	username, _ := c.Get("username").(string)
+
+	key, err := h.authService.BeginTOTPEnrollment(c.Request().Context(), userID, username)
+	if err != nil {
+		if errors.Is(err, ErrTwoFactorEnabled) {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": ErrTwoFactorEnabled.Error(),
+			})
+		}
+		slog.Error("failed to begin two-factor enrollment", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to start two-factor enrollment",
+		})
+	}
+
+	qr, err := qrCodeDataURI(key)
+	if err != nil {
+		slog.Error("failed to render QR code", slog.Any("error", err))
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, map[string]string{
+			"secret":      key.Secret(),
+			"otpauth_uri": key.URL(),
+			"qr_code":     qr,
+		})
+	}
+	return c.HTML(http.StatusOK, fmt.Sprintf(`
+		<p>Scan this code with your authenticator app, then enter the 6-digit code it shows.</p>
+		<img src="%s" alt="QR code" width="200" height="200">
+		<p>Or enter this key by hand: <code>%s</code></p>
+		<form method="POST" action="/settings/2fa/confirm">
+			%s
+			<input type="text" name="code" placeholder="6-digit code" autocomplete="one-time-code" required>
+			<button type="submit">Turn on</button>
+		</form>
+	`, html.EscapeString(qr), html.EscapeString(key.Secret()), csrfField(c)))
+}
+
+// Confirm authenticator enrollment (POST)
+func (h *AuthHandlers) ConfirmTwoFactor(c echo.Context) error {
+	userID := c.Get("user_id").(int32)
+
+	codes, err := h.authService.ConfirmTOTPEnrollment(c.Request().Context(), userID, c.FormValue("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidCode):
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid authentication code",
+			})
+		case errors.Is(err, ErrTwoFactorEnabled), errors.Is(err, ErrTwoFactorNotEnabled):
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": err.Error(),
+			})
+		default:
+			slog.Error("failed to confirm two-factor enrollment", slog.Any("error", err))
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to enable two-factor authentication",
+			})
+		}
+	}
+
+	return h.renderRecoveryCodes(c, "Two-factor authentication is on.", codes)
+}
+
+// Replace recovery codes (POST)
+func (h *AuthHandlers) RegenerateRecoveryCodes(c echo.Context) error {
+	userID := c.Get("user_id").(int32)
+	ctx := c.Request().Context()
+
+	enabled, err := h.authService.TwoFactorEnabled(ctx, userID)
+	if err == nil && !enabled {
+		err = ErrTwoFactorNotEnabled
+	}
+	if err != nil {
+		if errors.Is(err, ErrTwoFactorNotEnabled) {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": err.Error(),
+			})
+		}
+		slog.Error("failed to check two-factor status", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to generate recovery codes",
+		})
+	}
+
+	codes, err := h.authService.RegenerateRecoveryCodes(ctx, userID)
+	if err != nil {
+		slog.Error("failed to regenerate recovery codes", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to generate recovery codes",
+		})
+	}
+
+	return h.renderRecoveryCodes(c, "Your old recovery codes no longer work.", codes)
+}
+
+// Turn off two-factor (POST)
+func (h *AuthHandlers) DisableTwoFactor(c echo.Context) error {
+	userID := c.Get("user_id").(int32)
+
+	if err := h.authService.DisableTwoFactor(c.Request().Context(), userID, c.FormValue("password")); err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			return c.JSON(http.StatusUnauthorized, map[string]string{
+				"error": "Incorrect password",
+			})
+		}
+		slog.Error("failed to disable two-factor", slog.Any("error", err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to disable two-factor authentication",
+		})
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": "Two-factor authentication disabled",
+		})
+	}
+	return c.Redirect(http.StatusFound, "/settings/2fa")
+}
+
+// renderRecoveryCodes shows freshly generated recovery codes exactly once
+func (h *AuthHandlers) renderRecoveryCodes(c echo.Context, message string, codes []string) error {
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"message":        message,
+			"recovery_codes": codes,
+		})
+	}
+
+	var list strings.Builder
+	for _, code := range codes {
+		fmt.Fprintf(&list, "<li><code>%s</code></li>", code)
+	}
+	return c.HTML(http.StatusOK, fmt.Sprintf(`
+		<p>%s</p>
+		<p>Save these recovery codes somewhere safe. Each one can be used once if you lose your phone. They will not be shown again.</p>
+		<ul>%s</ul>
+		<p><a href="/settings/2fa">Done</a></p>
+	`, html.EscapeString(message), list.String()))
+}
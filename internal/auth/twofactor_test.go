@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func TestTOTPStep(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXP"
+	now := time.Unix(1_700_000_000, 0)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		at       time.Time
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", now, current, true},
+		{"previous step", now.Add(-totpPeriod * time.Second), current - 1, true},
+		{"next step", now.Add(totpPeriod * time.Second), current + 1, true},
+		{"two steps old", now.Add(-2 * totpPeriod * time.Second), 0, false},
+		{"two steps ahead", now.Add(2 * totpPeriod * time.Second), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := totp.GenerateCode(secret, tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			step, ok := totpStep(code, secret, now)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("totpStep = (%d, %v), want (%d, %v)", step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+// Each code signs in once; replaying it, or an older one, within its window is refused
+func TestVerifySecondFactorRefusesReplay(t *testing.T) {
+	ctx := context.Background()
+	a, db := newTestAuthService(t)
+	user := db.addUser(t, a, "grower", "correct horse battery staple")
+
+	key, err := a.BeginTOTPEnrollment(ctx, user.ID, user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	enrollCode, err := totp.GenerateCode(key.Secret(), now.Add(-totpPeriod*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.ConfirmTOTPEnrollment(ctx, user.ID, enrollCode); err != nil {
+		t.Fatalf("ConfirmTOTPEnrollment: %v", err)
+	}
+	if err := a.VerifySecondFactor(ctx, user.ID, enrollCode); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("enrollment code replayed at login: err = %v, want ErrInvalidCode", err)
+	}
+
+	code, err := totp.GenerateCode(key.Secret(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.VerifySecondFactor(ctx, user.ID, code); err != nil {
+		t.Fatalf("first use of a fresh code: %v", err)
+	}
+	if err := a.VerifySecondFactor(ctx, user.ID, code); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("replayed code: err = %v, want ErrInvalidCode", err)
+	}
+}
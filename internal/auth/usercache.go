@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// How long a loaded user is reused before it is read again
+	userCacheTTL = 30 * time.Second
+	// Upper bound on cached users, so a burst of logins cannot grow it without limit
+	userCacheSize = 1000
+
+	currentUserContextKey = "current_user"
+)
+
+// userCache keeps recently loaded active users for a short time so each request does not
+// need its own query. Changes made through AuthService evict the user straight away.
+type userCache struct {
+	mu      sync.Mutex
+	entries map[int32]userCacheEntry
+}
+
+type userCacheEntry struct {
+	user    database.User
+	expires time.Time
+}
+
+func newUserCache() *userCache {
+	return &userCache{entries: map[int32]userCacheEntry{}}
+}
+
+func (c *userCache) get(userID int32) (database.User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[userID]
+	if !ok || time.Now().After(entry.expires) {
+		return database.User{}, false
+	}
+	return entry.user, true
+}
+
+func (c *userCache) put(user database.User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= userCacheSize {
+		for id, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, id)
+			}
+		}
+	}
+	if len(c.entries) >= userCacheSize {
+		// Still full of live entries; any one can go
+		for id := range c.entries {
+			delete(c.entries, id)
+			break
+		}
+	}
+	c.entries[user.ID] = userCacheEntry{user: user, expires: now.Add(userCacheTTL)}
+}
+
+func (c *userCache) forget(userID int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, userID)
+}
+
+// CurrentUser loads an active user, returning ErrUserNotFound once the account has been
+// deactivated or deleted
+func (a *AuthService) CurrentUser(ctx context.Context, userID int32) (*database.User, error) {
+	if user, ok := a.users.get(userID); ok {
+		return &user, nil
+	}
+
+	user, err := a.db.GetUserByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	a.users.put(user)
+	return &user, nil
+}
+
+// forgetUser drops any cached copy of the user after their account changes
+func (a *AuthService) forgetUser(userID int32) {
+	a.users.forget(userID)
+}
+
+// GetCurrentUser returns the signed in user loaded by AuthMiddleware, loading it on first use
+// for requests authenticated by APIAuthMiddleware with a token
+func GetCurrentUser(c echo.Context) (*database.User, error) {
+	if user, ok := c.Get(currentUserContextKey).(*database.User); ok {
+		return user, nil
+	}
+
+	userID, ok := c.Get("user_id").(int32)
+	if !ok {
+		return nil, fmt.Errorf("user not found in context")
+	}
+	authService, ok := c.Get(authServiceContextKey).(*AuthService)
+	if !ok {
+		return nil, fmt.Errorf("auth service not found in context")
+	}
+
+	user, err := authService.CurrentUser(c.Request().Context(), userID)
+	if err != nil {
+		return nil, err
+	}
+	c.Set(currentUserContextKey, user)
+	return user, nil
+}
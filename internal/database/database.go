@@ -10,12 +10,13 @@ import (
 
 	"github.com/dukerupert/south-texas-farmer/internal/database/migrations"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 
 	_ "github.com/lib/pq" // for migrations only
 )
 
 type DB struct {
-	conn    *pgx.Conn
+	pool    *pgxpool.Pool
 	sqlDB   *sql.DB // Keep for migrations
 	Queries *Queries
 }
@@ -42,31 +43,32 @@ func NewDB(databaseURL string) (*DB, error) {
 		return nil, fmt.Errorf("failed to ensure database exists: %w", err)
 	}
 
-	// Create pgx connection for main operations
+	// Create pgx pool for main operations; a single pgx.Conn cannot be shared between
+	// concurrent requests and background jobs
 	ctx := context.Background()
-	conn, err := pgx.Connect(ctx, databaseURL)
+	pool, err := pgxpool.New(ctx, databaseURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
 
 	// Test the connection
-	if err := conn.Ping(ctx); err != nil {
-		conn.Close(ctx)
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
 	// Create standard sql.DB for migrations (goose compatibility)
 	sqlDB, err := sql.Open("postgres", databaseURL)
 	if err != nil {
-		conn.Close(ctx)
+		pool.Close()
 		return nil, fmt.Errorf("failed to open sql database for migrations: %w", err)
 	}
 
 	// Create SQLC queries instance
-	queries := New(conn)
+	queries := New(pool)
 
 	return &DB{
-		conn:    conn,
+		pool:    pool,
 		sqlDB:   sqlDB,
 		Queries: queries,
 	}, nil
@@ -141,16 +143,16 @@ func validateDatabaseName(name string) error {
 }
 
 func (db *DB) Close() {
-	if db.conn != nil {
-		db.conn.Close(context.Background())
+	if db.pool != nil {
+		db.pool.Close()
 	}
 	if db.sqlDB != nil {
 		db.sqlDB.Close()
 	}
 }
 
-func (db *DB) Conn() *pgx.Conn {
-	return db.conn
+func (db *DB) Pool() *pgxpool.Pool {
+	return db.pool
 }
 
 func (db *DB) RunMigrations(autoMigrate bool) error {
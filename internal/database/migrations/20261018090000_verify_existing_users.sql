@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Accounts created before self-service registration were set up by an
+-- administrator, so treat them as verified rather than locking them out
+UPDATE users SET is_verified = true WHERE is_verified IS DISTINCT FROM true;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 1;
+-- +goose StatementEnd
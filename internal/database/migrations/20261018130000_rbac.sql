@@ -0,0 +1,127 @@
+-- +goose Up
+-- +goose StatementBegin
+-- System roles are seeded below and cannot be deleted; custom roles can be added by admins
+CREATE TABLE roles (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) UNIQUE NOT NULL,
+    description VARCHAR(255),
+    is_system BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE TABLE permissions (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) UNIQUE NOT NULL,
+    description VARCHAR(255)
+);
+
+CREATE TABLE role_permissions (
+    role_id INTEGER NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    permission_id INTEGER NOT NULL REFERENCES permissions (id) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE user_roles (
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role_id INTEGER NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    granted_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (user_id, role_id)
+);
+
+CREATE INDEX idx_user_roles_role_id ON user_roles (role_id);
+
+INSERT INTO
+    roles (name, description, is_system)
+VALUES (
+        'admin',
+        'Full access to everything',
+        true
+    ),
+    (
+        'manager',
+        'Manages files and can view users',
+        true
+    ),
+    (
+        'worker',
+        'Reads and uploads files',
+        true
+    ),
+    (
+        'viewer',
+        'Read-only access to files',
+        true
+    );
+
+INSERT INTO
+    permissions (name, description)
+VALUES (
+        'files:read',
+        'View and download files'
+    ),
+    (
+        'files:write',
+        'Upload and edit files'
+    ),
+    ('files:delete', 'Delete files'),
+    ('users:read', 'View user accounts'),
+    (
+        'users:manage',
+        'Create, edit and deactivate user accounts'
+    ),
+    (
+        'roles:manage',
+        'Create roles and assign them to users'
+    );
+
+INSERT INTO
+    role_permissions (role_id, permission_id)
+SELECT r.id, p.id
+FROM roles r
+    JOIN permissions p ON (
+        r.name = 'admin'
+        OR (
+            r.name = 'manager'
+            AND p.name IN (
+                'files:read',
+                'files:write',
+                'files:delete',
+                'users:read'
+            )
+        )
+        OR (
+            r.name = 'worker'
+            AND p.name IN ('files:read', 'files:write')
+        )
+        OR (
+            r.name = 'viewer'
+            AND p.name = 'files:read'
+        )
+    );
+
+-- Existing accounts: the first one becomes the admin, everyone else keeps working as before
+INSERT INTO
+    user_roles (user_id, role_id)
+SELECT u.id, r.id
+FROM users u
+    JOIN roles r ON r.name = CASE
+        WHEN u.id = (
+            SELECT MIN(id)
+            FROM users
+        ) THEN 'admin'
+        ELSE 'worker'
+    END;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_user_roles_role_id;
+
+DROP TABLE IF EXISTS user_roles;
+
+DROP TABLE IF EXISTS role_permissions;
+
+DROP TABLE IF EXISTS permissions;
+
+DROP TABLE IF EXISTS roles;
+-- +goose StatementEnd
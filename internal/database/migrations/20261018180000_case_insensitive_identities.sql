@@ -0,0 +1,107 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Usernames and emails are matched without regard to case. Accounts that only
+-- differed by case are renamed here, keeping the oldest account's value, and
+-- every change is recorded so an administrator can follow up with the owners.
+CREATE TABLE identity_conflicts (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    field VARCHAR(16) NOT NULL,
+    original_value VARCHAR(255) NOT NULL,
+    new_value VARCHAR(255) NOT NULL,
+    kept_user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- A new value can itself clash with an existing account, so a further suffix is
+-- added until it is free.
+DO $$
+DECLARE
+    r RECORD;
+    candidate TEXT;
+    suffix TEXT;
+    attempt INTEGER;
+BEGIN
+    FOR r IN
+        SELECT
+            id,
+            username,
+            first_value(id) OVER (PARTITION BY lower(username) ORDER BY id) AS kept_id
+        FROM users
+        ORDER BY id
+    LOOP
+        CONTINUE WHEN r.id = r.kept_id;
+        attempt := 0;
+        LOOP
+            suffix := '-' || r.id || CASE WHEN attempt > 0 THEN '-' || attempt ELSE '' END;
+            candidate := left(r.username, 50 - length(suffix)) || suffix;
+            EXIT WHEN NOT EXISTS (SELECT 1 FROM users WHERE lower(username) = lower(candidate))
+                AND NOT EXISTS (SELECT 1 FROM identity_conflicts WHERE field = 'username' AND lower(new_value) = lower(candidate));
+            attempt := attempt + 1;
+        END LOOP;
+        INSERT INTO identity_conflicts (user_id, field, original_value, new_value, kept_user_id)
+        VALUES (r.id, 'username', r.username, candidate, r.kept_id);
+    END LOOP;
+
+    FOR r IN
+        SELECT
+            id,
+            email,
+            first_value(id) OVER (PARTITION BY lower(email) ORDER BY id) AS kept_id
+        FROM users
+        ORDER BY id
+    LOOP
+        CONTINUE WHEN r.id = r.kept_id;
+        attempt := 0;
+        LOOP
+            suffix := '+conflict-' || r.id || CASE WHEN attempt > 0 THEN '-' || attempt ELSE '' END;
+            candidate := left(split_part(r.email, '@', 1), 200) || suffix || '@' || split_part(r.email, '@', 2);
+            EXIT WHEN NOT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower(candidate))
+                AND NOT EXISTS (SELECT 1 FROM identity_conflicts WHERE field = 'email' AND lower(new_value) = lower(candidate));
+            attempt := attempt + 1;
+        END LOOP;
+        INSERT INTO identity_conflicts (user_id, field, original_value, new_value, kept_user_id)
+        VALUES (r.id, 'email', r.email, candidate, r.kept_id);
+    END LOOP;
+END $$;
+
+UPDATE users
+SET username = c.new_value
+FROM identity_conflicts c
+WHERE c.user_id = users.id AND c.field = 'username';
+
+UPDATE users
+SET email = c.new_value
+FROM identity_conflicts c
+WHERE c.user_id = users.id AND c.field = 'email';
+
+ALTER TABLE users DROP CONSTRAINT users_username_key;
+
+ALTER TABLE users DROP CONSTRAINT users_email_key;
+
+DROP INDEX IF EXISTS idx_users_username;
+
+DROP INDEX IF EXISTS idx_users_email;
+
+CREATE UNIQUE INDEX idx_users_username_lower ON users (lower(username));
+
+CREATE UNIQUE INDEX idx_users_email_lower ON users (lower(email));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_users_email_lower;
+
+DROP INDEX IF EXISTS idx_users_username_lower;
+
+CREATE INDEX idx_users_username ON users (username);
+
+CREATE INDEX idx_users_email ON users (email);
+
+ALTER TABLE users ADD CONSTRAINT users_username_key UNIQUE (username);
+
+ALTER TABLE users ADD CONSTRAINT users_email_key UNIQUE (email);
+
+-- Renamed accounts keep their new names; the report goes with the feature
+DROP TABLE IF EXISTS identity_conflicts;
+-- +goose StatementEnd
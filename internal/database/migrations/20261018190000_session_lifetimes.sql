@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Logins now end at a fixed time as well as after a period of inactivity. Existing
+-- logins keep the seven days the session cookie used to last.
+ALTER TABLE user_sessions
+ADD COLUMN expires_at TIMESTAMP WITH TIME ZONE,
+ADD COLUMN remember BOOLEAN NOT NULL DEFAULT FALSE,
+ADD COLUMN rotate_pending BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE user_sessions
+SET expires_at = COALESCE(created_at, NOW()) + INTERVAL '7 days';
+
+ALTER TABLE user_sessions ALTER COLUMN expires_at SET NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE user_sessions
+DROP COLUMN IF EXISTS rotate_pending,
+DROP COLUMN IF EXISTS remember,
+DROP COLUMN IF EXISTS expires_at;
+-- +goose StatementEnd
@@ -0,0 +1,58 @@
+-- +goose Up
+-- +goose StatementBegin
+-- An append-only record of authentication and account events. User IDs are
+-- kept without foreign keys so the history outlives deleted accounts.
+CREATE TABLE security_events (
+    id BIGSERIAL PRIMARY KEY,
+    event VARCHAR(64) NOT NULL,
+    user_id INTEGER,
+    actor_id INTEGER,
+    ip_address VARCHAR(45),
+    user_agent TEXT,
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_security_events_created_at ON security_events (created_at);
+
+CREATE INDEX idx_security_events_user_id ON security_events (user_id, created_at);
+
+CREATE INDEX idx_security_events_event ON security_events (event, created_at);
+
+-- Rows may be pruned by age but never changed
+CREATE FUNCTION security_events_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'security_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER security_events_no_update
+BEFORE UPDATE ON security_events
+FOR EACH ROW EXECUTE FUNCTION security_events_append_only();
+
+INSERT INTO
+    permissions (name, description)
+VALUES (
+        'audit:read',
+        'View and export the security event log'
+    );
+
+INSERT INTO
+    role_permissions (role_id, permission_id)
+SELECT r.id, p.id
+FROM roles r
+    JOIN permissions p ON p.name = 'audit:read'
+WHERE
+    r.name = 'admin';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM permissions WHERE name = 'audit:read';
+
+DROP TRIGGER IF EXISTS security_events_no_update ON security_events;
+
+DROP FUNCTION IF EXISTS security_events_append_only;
+
+DROP TABLE IF EXISTS security_events;
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+INSERT INTO
+    permissions (name, description)
+VALUES (
+        'users:impersonate',
+        'Sign in as another user to see what they see'
+    );
+
+INSERT INTO
+    role_permissions (role_id, permission_id)
+SELECT r.id, p.id
+FROM roles r
+    JOIN permissions p ON p.name = 'users:impersonate'
+WHERE
+    r.name = 'admin';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM permissions WHERE name = 'users:impersonate';
+-- +goose StatementEnd
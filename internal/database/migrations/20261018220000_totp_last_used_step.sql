@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The time step of the last code accepted, so each code works only once (RFC 6238 §5.2).
+-- NULL until the first code is used.
+ALTER TABLE user_totp ADD COLUMN last_used_step BIGINT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE user_totp DROP COLUMN IF EXISTS last_used_step;
+-- +goose StatementEnd
@@ -8,11 +8,80 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+type ApiToken struct {
+	ID         int32              `json:"id"`
+	UserID     int32              `json:"user_id"`
+	Name       string             `json:"name"`
+	Prefix     string             `json:"prefix"`
+	TokenHash  string             `json:"token_hash"`
+	Scopes     []string           `json:"scopes"`
+	ExpiresAt  pgtype.Timestamptz `json:"expires_at"`
+	LastUsedAt pgtype.Timestamptz `json:"last_used_at"`
+	CreatedAt  pgtype.Timestamptz `json:"created_at"`
+}
+
+type IdentityConflict struct {
+	ID            int32              `json:"id"`
+	UserID        int32              `json:"user_id"`
+	Field         string             `json:"field"`
+	OriginalValue string             `json:"original_value"`
+	NewValue      string             `json:"new_value"`
+	KeptUserID    int32              `json:"kept_user_id"`
+	CreatedAt     pgtype.Timestamptz `json:"created_at"`
+}
+
+type LoginThrottle struct {
+	Scope         string             `json:"scope"`
+	Key           string             `json:"key"`
+	Failures      int32              `json:"failures"`
+	LastFailureAt pgtype.Timestamptz `json:"last_failure_at"`
+	LockedUntil   pgtype.Timestamptz `json:"locked_until"`
+}
+
+type PasswordResetToken struct {
+	ID        int32              `json:"id"`
+	UserID    int32              `json:"user_id"`
+	TokenHash string             `json:"token_hash"`
+	ExpiresAt pgtype.Timestamptz `json:"expires_at"`
+	UsedAt    pgtype.Timestamptz `json:"used_at"`
+	CreatedAt pgtype.Timestamptz `json:"created_at"`
+}
+
+type Permission struct {
+	ID          int32       `json:"id"`
+	Name        string      `json:"name"`
+	Description pgtype.Text `json:"description"`
+}
+
+type Role struct {
+	ID          int32              `json:"id"`
+	Name        string             `json:"name"`
+	Description pgtype.Text        `json:"description"`
+	IsSystem    bool               `json:"is_system"`
+	CreatedAt   pgtype.Timestamptz `json:"created_at"`
+}
+
+type RolePermission struct {
+	RoleID       int32 `json:"role_id"`
+	PermissionID int32 `json:"permission_id"`
+}
+
+type SecurityEvent struct {
+	ID        int64              `json:"id"`
+	Event     string             `json:"event"`
+	UserID    pgtype.Int4        `json:"user_id"`
+	ActorID   pgtype.Int4        `json:"actor_id"`
+	IpAddress pgtype.Text        `json:"ip_address"`
+	UserAgent pgtype.Text        `json:"user_agent"`
+	Details   []byte             `json:"details"`
+	CreatedAt pgtype.Timestamptz `json:"created_at"`
+}
+
 type User struct {
 	ID           int32              `json:"id"`
 	Username     string             `json:"username"`
 	Email        string             `json:"email"`
-	PasswordHash string             `json:"password_hash"`
+	PasswordHash string             `json:"-"`
 	FirstName    pgtype.Text        `json:"first_name"`
 	LastName     pgtype.Text        `json:"last_name"`
 	IsActive     pgtype.Bool        `json:"is_active"`
@@ -20,3 +89,63 @@ type User struct {
 	CreatedAt    pgtype.Timestamptz `json:"created_at"`
 	UpdatedAt    pgtype.Timestamptz `json:"updated_at"`
 }
+
+type UserIdentity struct {
+	ID          int32              `json:"id"`
+	UserID      int32              `json:"user_id"`
+	Provider    string             `json:"provider"`
+	Subject     string             `json:"subject"`
+	Email       pgtype.Text        `json:"email"`
+	CreatedAt   pgtype.Timestamptz `json:"created_at"`
+	LastLoginAt pgtype.Timestamptz `json:"last_login_at"`
+}
+
+type UserRecoveryCode struct {
+	ID        int32              `json:"id"`
+	UserID    int32              `json:"user_id"`
+	CodeHash  string             `json:"code_hash"`
+	UsedAt    pgtype.Timestamptz `json:"used_at"`
+	CreatedAt pgtype.Timestamptz `json:"created_at"`
+}
+
+type UserRole struct {
+	UserID    int32              `json:"user_id"`
+	RoleID    int32              `json:"role_id"`
+	GrantedAt pgtype.Timestamptz `json:"granted_at"`
+}
+
+type UserSession struct {
+	ID            string             `json:"id"`
+	UserID        int32              `json:"user_id"`
+	CreatedAt     pgtype.Timestamptz `json:"created_at"`
+	LastSeenAt    pgtype.Timestamptz `json:"last_seen_at"`
+	IpAddress     pgtype.Text        `json:"ip_address"`
+	UserAgent     pgtype.Text        `json:"user_agent"`
+	ExpiresAt     pgtype.Timestamptz `json:"expires_at"`
+	Remember      bool               `json:"remember"`
+	RotatePending bool               `json:"rotate_pending"`
+}
+
+type UserTotp struct {
+	UserID       int32              `json:"user_id"`
+	Secret       string             `json:"secret"`
+	EnabledAt    pgtype.Timestamptz `json:"enabled_at"`
+	CreatedAt    pgtype.Timestamptz `json:"created_at"`
+	LastUsedStep pgtype.Int8        `json:"last_used_step"`
+}
+
+type WebauthnCredential struct {
+	ID              int32              `json:"id"`
+	UserID          int32              `json:"user_id"`
+	CredentialID    []byte             `json:"credential_id"`
+	PublicKey       []byte             `json:"public_key"`
+	AttestationType string             `json:"attestation_type"`
+	Transports      []string           `json:"transports"`
+	Aaguid          []byte             `json:"aaguid"`
+	SignCount       int64              `json:"sign_count"`
+	BackupEligible  bool               `json:"backup_eligible"`
+	BackupState     bool               `json:"backup_state"`
+	Name            string             `json:"name"`
+	CreatedAt       pgtype.Timestamptz `json:"created_at"`
+	LastUsedAt      pgtype.Timestamptz `json:"last_used_at"`
+}
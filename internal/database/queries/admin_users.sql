@@ -0,0 +1,57 @@
+-- name: GetAnyUserByID :one
+SELECT
+    id,
+    username,
+    email,
+    password_hash,
+    first_name,
+    last_name,
+    is_active,
+    is_verified,
+    created_at,
+    updated_at
+FROM users
+WHERE
+    id = $1;
+
+-- name: ListUsers :many
+SELECT
+    id,
+    username,
+    email,
+    first_name,
+    last_name,
+    is_active,
+    is_verified,
+    created_at,
+    updated_at
+FROM users
+WHERE (
+        sqlc.narg(search)::TEXT IS NULL
+        OR username ILIKE '%' || sqlc.narg(search) || '%'
+        OR email ILIKE '%' || sqlc.narg(search) || '%'
+    )
+    AND (
+        sqlc.narg(is_active)::BOOLEAN IS NULL
+        OR is_active = sqlc.narg(is_active)
+    )
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg(page_limit)
+OFFSET
+    sqlc.arg(page_offset);
+
+-- name: CountUsers :one
+SELECT COUNT(*)
+FROM users
+WHERE (
+        sqlc.narg(search)::TEXT IS NULL
+        OR username ILIKE '%' || sqlc.narg(search) || '%'
+        OR email ILIKE '%' || sqlc.narg(search) || '%'
+    )
+    AND (
+        sqlc.narg(is_active)::BOOLEAN IS NULL
+        OR is_active = sqlc.narg(is_active)
+    );
+
+-- name: ReactivateUser :exec
+UPDATE users SET is_active = true, updated_at = NOW() WHERE id = $1;
@@ -0,0 +1,58 @@
+-- name: CreateAPIToken :one
+INSERT INTO
+    api_tokens (
+        user_id,
+        name,
+        prefix,
+        token_hash,
+        scopes,
+        expires_at
+    )
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING
+    id,
+    user_id,
+    name,
+    prefix,
+    token_hash,
+    scopes,
+    expires_at,
+    last_used_at,
+    created_at;
+
+-- name: GetAPITokenByHash :one
+SELECT
+    t.id,
+    t.user_id,
+    t.scopes,
+    t.expires_at,
+    t.last_used_at,
+    u.username,
+    u.is_verified
+FROM api_tokens t
+    JOIN users u ON u.id = t.user_id
+WHERE
+    t.token_hash = $1
+    AND u.is_active = true;
+
+-- name: ListAPITokensByUser :many
+SELECT
+    id,
+    user_id,
+    name,
+    prefix,
+    token_hash,
+    scopes,
+    expires_at,
+    last_used_at,
+    created_at
+FROM api_tokens
+WHERE
+    user_id = $1
+ORDER BY created_at DESC;
+
+-- name: TouchAPIToken :exec
+UPDATE api_tokens SET last_used_at = NOW() WHERE id = $1;
+
+-- name: DeleteAPIToken :execrows
+DELETE FROM api_tokens WHERE id = $1 AND user_id = $2;
@@ -0,0 +1,11 @@
+-- name: ListIdentityConflicts :many
+SELECT
+    id,
+    user_id,
+    field,
+    original_value,
+    new_value,
+    kept_user_id,
+    created_at
+FROM identity_conflicts
+ORDER BY id;
@@ -0,0 +1,72 @@
+-- name: GetLoginThrottle :one
+SELECT
+    scope,
+    key,
+    failures,
+    last_failure_at,
+    locked_until
+FROM login_throttles
+WHERE
+    scope = $1
+    AND key = $2;
+
+-- name: RecordLoginFailure :one
+INSERT INTO
+    login_throttles (
+        scope,
+        key,
+        failures,
+        last_failure_at
+    )
+VALUES (
+        sqlc.arg(scope),
+        sqlc.arg(key),
+        1,
+        NOW()
+    )
+ON CONFLICT (scope, key) DO
+UPDATE
+SET
+    failures = CASE
+        WHEN login_throttles.last_failure_at < sqlc.arg(reset_before) THEN 1
+        ELSE login_throttles.failures + 1
+    END,
+    last_failure_at = NOW()
+RETURNING
+    scope,
+    key,
+    failures,
+    last_failure_at,
+    locked_until;
+
+-- name: LockLoginThrottle :exec
+UPDATE login_throttles
+SET
+    locked_until = $3
+WHERE
+    scope = $1
+    AND key = $2;
+
+-- name: ClearLoginThrottle :execrows
+DELETE FROM login_throttles WHERE scope = $1 AND key = $2;
+
+-- name: ListLoginLockouts :many
+SELECT
+    scope,
+    key,
+    failures,
+    last_failure_at,
+    locked_until
+FROM login_throttles
+WHERE
+    locked_until > NOW()
+ORDER BY locked_until DESC;
+
+-- name: DeleteStaleLoginThrottles :exec
+DELETE FROM login_throttles
+WHERE
+    last_failure_at < $1
+    AND (
+        locked_until IS NULL
+        OR locked_until < NOW()
+    );
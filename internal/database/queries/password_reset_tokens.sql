@@ -0,0 +1,39 @@
+-- name: CreatePasswordResetToken :exec
+INSERT INTO
+    password_reset_tokens (user_id, token_hash, expires_at)
+VALUES ($1, $2, $3);
+
+-- name: GetPasswordResetTokenUser :one
+SELECT
+    users.id,
+    users.username,
+    users.email
+FROM
+    password_reset_tokens
+    JOIN users ON users.id = password_reset_tokens.user_id
+WHERE
+    password_reset_tokens.token_hash = $1
+    AND password_reset_tokens.used_at IS NULL
+    AND password_reset_tokens.expires_at > NOW();
+
+-- name: ConsumePasswordResetToken :one
+UPDATE password_reset_tokens
+SET
+    used_at = NOW()
+WHERE
+    token_hash = $1
+    AND used_at IS NULL
+    AND expires_at > NOW()
+RETURNING
+    user_id;
+
+-- name: InvalidatePasswordResetTokens :exec
+UPDATE password_reset_tokens
+SET
+    used_at = NOW()
+WHERE
+    user_id = $1
+    AND used_at IS NULL;
+
+-- name: DeleteExpiredPasswordResetTokens :exec
+DELETE FROM password_reset_tokens WHERE expires_at < NOW();
@@ -0,0 +1,111 @@
+-- name: ListUserRoles :many
+SELECT r.name
+FROM roles r
+    JOIN user_roles ur ON ur.role_id = r.id
+WHERE
+    ur.user_id = $1
+ORDER BY r.name;
+
+-- name: ListUserPermissions :many
+SELECT DISTINCT
+    p.name
+FROM
+    permissions p
+    JOIN role_permissions rp ON rp.permission_id = p.id
+    JOIN user_roles ur ON ur.role_id = rp.role_id
+WHERE
+    ur.user_id = $1
+ORDER BY p.name;
+
+-- name: AssignUserRole :execrows
+INSERT INTO
+    user_roles (user_id, role_id)
+SELECT sqlc.arg(user_id)::INTEGER, id
+FROM roles
+WHERE
+    name = sqlc.arg(role_name)
+ON CONFLICT DO NOTHING;
+
+-- name: RemoveUserRole :execrows
+DELETE FROM user_roles
+WHERE
+    user_id = sqlc.arg(user_id)
+    AND role_id = (
+        SELECT id
+        FROM roles
+        WHERE
+            name = sqlc.arg(role_name)
+    );
+
+-- name: ListRoles :many
+SELECT
+    id,
+    name,
+    description,
+    is_system,
+    created_at
+FROM roles
+ORDER BY name;
+
+-- name: GetRoleByName :one
+SELECT
+    id,
+    name,
+    description,
+    is_system,
+    created_at
+FROM roles
+WHERE
+    name = $1;
+
+-- name: CreateRole :one
+INSERT INTO
+    roles (name, description)
+VALUES ($1, $2)
+RETURNING
+    id,
+    name,
+    description,
+    is_system,
+    created_at;
+
+-- name: DeleteRole :execrows
+DELETE FROM roles WHERE name = $1 AND is_system = false;
+
+-- name: ListPermissions :many
+SELECT id, name, description FROM permissions ORDER BY name;
+
+-- name: ListRolePermissions :many
+SELECT p.name
+FROM permissions p
+    JOIN role_permissions rp ON rp.permission_id = p.id
+    JOIN roles r ON r.id = rp.role_id
+WHERE
+    r.name = $1
+ORDER BY p.name;
+
+-- name: GrantRolePermission :execrows
+INSERT INTO
+    role_permissions (role_id, permission_id)
+SELECT r.id, p.id
+FROM roles r, permissions p
+WHERE
+    r.name = sqlc.arg(role_name)
+    AND p.name = sqlc.arg(permission_name)
+ON CONFLICT DO NOTHING;
+
+-- name: RevokeRolePermission :execrows
+DELETE FROM role_permissions
+WHERE
+    role_id = (
+        SELECT id
+        FROM roles
+        WHERE
+            name = sqlc.arg(role_name)
+    )
+    AND permission_id = (
+        SELECT id
+        FROM permissions
+        WHERE
+            name = sqlc.arg(permission_name)
+    );
@@ -0,0 +1,76 @@
+-- name: CreateSecurityEvent :exec
+INSERT INTO
+    security_events (
+        event,
+        user_id,
+        actor_id,
+        ip_address,
+        user_agent,
+        details
+    )
+VALUES ($1, $2, $3, $4, $5, $6);
+
+-- name: ListSecurityEvents :many
+SELECT
+    id,
+    event,
+    user_id,
+    actor_id,
+    ip_address,
+    user_agent,
+    details,
+    created_at
+FROM security_events
+WHERE (
+        sqlc.narg(event)::TEXT IS NULL
+        OR event = sqlc.narg(event)
+    )
+    AND (
+        sqlc.narg(user_id)::INTEGER IS NULL
+        OR user_id = sqlc.narg(user_id)
+        OR actor_id = sqlc.narg(user_id)
+    )
+    AND (
+        sqlc.narg(ip_address)::TEXT IS NULL
+        OR ip_address = sqlc.narg(ip_address)
+    )
+    AND (
+        sqlc.narg(since)::TIMESTAMPTZ IS NULL
+        OR created_at >= sqlc.narg(since)
+    )
+    AND (
+        sqlc.narg(until)::TIMESTAMPTZ IS NULL
+        OR created_at < sqlc.narg(until)
+    )
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg(page_limit)
+OFFSET
+    sqlc.arg(page_offset);
+
+-- name: CountSecurityEvents :one
+SELECT COUNT(*)
+FROM security_events
+WHERE (
+        sqlc.narg(event)::TEXT IS NULL
+        OR event = sqlc.narg(event)
+    )
+    AND (
+        sqlc.narg(user_id)::INTEGER IS NULL
+        OR user_id = sqlc.narg(user_id)
+        OR actor_id = sqlc.narg(user_id)
+    )
+    AND (
+        sqlc.narg(ip_address)::TEXT IS NULL
+        OR ip_address = sqlc.narg(ip_address)
+    )
+    AND (
+        sqlc.narg(since)::TIMESTAMPTZ IS NULL
+        OR created_at >= sqlc.narg(since)
+    )
+    AND (
+        sqlc.narg(until)::TIMESTAMPTZ IS NULL
+        OR created_at < sqlc.narg(until)
+    );
+
+-- name: DeleteSecurityEventsBefore :execrows
+DELETE FROM security_events WHERE created_at < $1;
@@ -0,0 +1,60 @@
+-- name: GetUserTOTP :one
+SELECT user_id, secret, enabled_at, created_at, last_used_step
+FROM user_totp
+WHERE
+    user_id = $1;
+
+-- name: UpsertPendingUserTOTP :exec
+INSERT INTO
+    user_totp (user_id, secret)
+VALUES ($1, $2)
+ON CONFLICT (user_id) DO
+UPDATE
+SET
+    secret = EXCLUDED.secret,
+    enabled_at = NULL,
+    last_used_step = NULL,
+    created_at = NOW()
+WHERE
+    user_totp.enabled_at IS NULL;
+
+-- name: EnableUserTOTP :exec
+UPDATE user_totp SET enabled_at = NOW() WHERE user_id = $1;
+
+-- name: ClaimTOTPStep :execrows
+UPDATE user_totp
+SET
+    last_used_step = sqlc.arg(step)::BIGINT
+WHERE
+    user_id = sqlc.arg(user_id)
+    AND (
+        last_used_step IS NULL
+        OR last_used_step < sqlc.arg(step)::BIGINT
+    );
+
+-- name: DeleteUserTOTP :exec
+DELETE FROM user_totp WHERE user_id = $1;
+
+-- name: CreateRecoveryCode :exec
+INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2);
+
+-- name: ConsumeRecoveryCode :one
+UPDATE user_recovery_codes
+SET
+    used_at = NOW()
+WHERE
+    user_id = $1
+    AND code_hash = $2
+    AND used_at IS NULL
+RETURNING
+    id;
+
+-- name: CountUnusedRecoveryCodes :one
+SELECT COUNT(*)
+FROM user_recovery_codes
+WHERE
+    user_id = $1
+    AND used_at IS NULL;
+
+-- name: DeleteRecoveryCodes :exec
+DELETE FROM user_recovery_codes WHERE user_id = $1;
@@ -0,0 +1,56 @@
+-- name: CreateUserIdentity :one
+INSERT INTO
+    user_identities (
+        user_id,
+        provider,
+        subject,
+        email
+    )
+VALUES ($1, $2, $3, $4)
+RETURNING
+    id,
+    user_id,
+    provider,
+    subject,
+    email,
+    created_at,
+    last_login_at;
+
+-- name: GetUserIdentity :one
+SELECT
+    id,
+    user_id,
+    provider,
+    subject,
+    email,
+    created_at,
+    last_login_at
+FROM user_identities
+WHERE
+    provider = $1
+    AND subject = $2;
+
+-- name: ListUserIdentities :many
+SELECT
+    id,
+    user_id,
+    provider,
+    subject,
+    email,
+    created_at,
+    last_login_at
+FROM user_identities
+WHERE
+    user_id = $1
+ORDER BY provider;
+
+-- name: TouchUserIdentity :exec
+UPDATE user_identities
+SET
+    email = $2,
+    last_login_at = NOW()
+WHERE
+    id = $1;
+
+-- name: DeleteUserIdentity :execrows
+DELETE FROM user_identities WHERE id = $1 AND user_id = $2;
@@ -0,0 +1,104 @@
+-- name: CreateUserSession :exec
+INSERT INTO
+    user_sessions (
+        id,
+        user_id,
+        ip_address,
+        user_agent,
+        expires_at,
+        remember
+    )
+VALUES ($1, $2, $3, $4, $5, $6);
+
+-- name: GetUserSession :one
+SELECT
+    id,
+    user_id,
+    created_at,
+    last_seen_at,
+    ip_address,
+    user_agent,
+    expires_at,
+    remember,
+    rotate_pending
+FROM user_sessions
+WHERE
+    id = $1;
+
+-- name: TouchUserSession :exec
+UPDATE user_sessions
+SET
+    last_seen_at = NOW(),
+    ip_address = $2
+WHERE
+    id = $1;
+
+-- name: MarkUserSessionsForRotation :exec
+UPDATE user_sessions SET rotate_pending = TRUE WHERE user_id = $1;
+
+-- name: MarkRoleSessionsForRotation :exec
+UPDATE user_sessions
+SET
+    rotate_pending = TRUE
+WHERE
+    user_id IN (
+        SELECT ur.user_id
+        FROM user_roles ur
+            JOIN roles r ON r.id = ur.role_id
+        WHERE
+            r.name = sqlc.arg(role_name)
+    );
+
+-- name: ClaimUserSessionRotation :execrows
+UPDATE user_sessions
+SET
+    rotate_pending = FALSE
+WHERE
+    id = $1
+    AND rotate_pending;
+
+-- name: ListUserSessions :many
+SELECT
+    id,
+    user_id,
+    created_at,
+    last_seen_at,
+    ip_address,
+    user_agent,
+    expires_at,
+    remember,
+    rotate_pending
+FROM user_sessions
+WHERE
+    user_id = $1
+ORDER BY last_seen_at DESC;
+
+-- name: ListSessions :many
+SELECT
+    s.id,
+    s.user_id,
+    u.username,
+    s.created_at,
+    s.last_seen_at,
+    s.ip_address,
+    s.user_agent,
+    s.expires_at,
+    s.remember
+FROM user_sessions s
+    JOIN users u ON u.id = s.user_id
+WHERE
+    sqlc.narg(user_id)::INTEGER IS NULL
+    OR s.user_id = sqlc.narg(user_id)
+ORDER BY s.last_seen_at DESC
+LIMIT sqlc.arg(page_limit)
+OFFSET
+    sqlc.arg(page_offset);
+
+-- name: DeleteUserSession :execrows
+DELETE FROM user_sessions WHERE id = $1;
+
+-- name: DeleteUserSessionForUser :execrows
+DELETE FROM user_sessions WHERE id = $1 AND user_id = $2;
+
+-- name: DeleteUserSessions :exec
+DELETE FROM user_sessions WHERE user_id = $1;
@@ -29,7 +29,7 @@ SELECT
     updated_at
 FROM users
 WHERE
-    username = $1
+    lower(username) = lower($1)
     AND is_active = true;
 
 -- name: GetUserByEmail :one
@@ -46,7 +46,7 @@ SELECT
     updated_at
 FROM users
 WHERE
-    email = $1
+    lower(email) = lower($1)
     AND is_active = true;
 
 -- name: CreateUser :one
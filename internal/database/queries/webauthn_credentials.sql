@@ -0,0 +1,99 @@
+-- name: CreateWebAuthnCredential :one
+INSERT INTO
+    webauthn_credentials (
+        user_id,
+        credential_id,
+        public_key,
+        attestation_type,
+        transports,
+        aaguid,
+        sign_count,
+        backup_eligible,
+        backup_state,
+        name
+    )
+VALUES (
+        $1,
+        $2,
+        $3,
+        $4,
+        $5,
+        $6,
+        $7,
+        $8,
+        $9,
+        $10
+    )
+RETURNING
+    id,
+    user_id,
+    credential_id,
+    public_key,
+    attestation_type,
+    transports,
+    aaguid,
+    sign_count,
+    backup_eligible,
+    backup_state,
+    name,
+    created_at,
+    last_used_at;
+
+-- name: GetWebAuthnCredentialByCredentialID :one
+SELECT
+    id,
+    user_id,
+    credential_id,
+    public_key,
+    attestation_type,
+    transports,
+    aaguid,
+    sign_count,
+    backup_eligible,
+    backup_state,
+    name,
+    created_at,
+    last_used_at
+FROM webauthn_credentials
+WHERE
+    credential_id = $1;
+
+-- name: ListWebAuthnCredentialsByUser :many
+SELECT
+    id,
+    user_id,
+    credential_id,
+    public_key,
+    attestation_type,
+    transports,
+    aaguid,
+    sign_count,
+    backup_eligible,
+    backup_state,
+    name,
+    created_at,
+    last_used_at
+FROM webauthn_credentials
+WHERE
+    user_id = $1
+ORDER BY created_at;
+
+-- name: UpdateWebAuthnCredentialUsage :exec
+UPDATE webauthn_credentials
+SET
+    sign_count = $2,
+    backup_state = $3,
+    last_used_at = NOW()
+WHERE
+    credential_id = $1;
+
+-- name: RenameWebAuthnCredential :execrows
+UPDATE webauthn_credentials
+SET
+    name = $3
+WHERE
+    id = $1
+    AND user_id = $2;
+
+-- name: DeleteWebAuthnCredential :execrows
+DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2;
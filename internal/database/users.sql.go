@@ -47,7 +47,7 @@ RETURNING
 type CreateUserParams struct {
 	Username     string      `json:"username"`
 	Email        string      `json:"email"`
-	PasswordHash string      `json:"password_hash"`
+	PasswordHash string      `json:"-"`
 	FirstName    pgtype.Text `json:"first_name"`
 	LastName     pgtype.Text `json:"last_name"`
 }
@@ -110,7 +110,7 @@ SELECT
     updated_at
 FROM users
 WHERE
-    email = $1
+    lower(email) = lower($1)
     AND is_active = true
 `
 
@@ -182,7 +182,7 @@ SELECT
     updated_at
 FROM users
 WHERE
-    username = $1
+    lower(username) = lower($1)
     AND is_active = true
 `
 
@@ -349,7 +349,7 @@ WHERE
 
 type UpdateUserPasswordParams struct {
 	ID           int32  `json:"id"`
-	PasswordHash string `json:"password_hash"`
+	PasswordHash string `json:"-"`
 }
 
 func (q *Queries) UpdateUserPassword(ctx context.Context, arg UpdateUserPasswordParams) error {
@@ -6,12 +6,16 @@ import (
 	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/antonlindstrom/pgstore"
 	"github.com/dukerupert/south-texas-farmer/internal/auth"
 	"github.com/dukerupert/south-texas-farmer/internal/database"
+	"github.com/dukerupert/south-texas-farmer/internal/mailer"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -36,12 +40,53 @@ type DatabaseConfig struct {
 	PostgresSSL      string
 }
 
+// MailConfig selects and configures the outbound mailer
+type MailConfig struct {
+	Driver    string // "smtp" or "log"
+	Host      string
+	Port      string
+	Username  string
+	Password  string
+	From      string
+	OutboxDir string
+}
+
+// WebAuthnConfig identifies this site as a passkey relying party
+type WebAuthnConfig struct {
+	RPID    string
+	RPName  string
+	Origins []string
+}
+
+// PasswordConfig tunes the policy new passwords must meet and how they are hashed
+type PasswordConfig struct {
+	MinLength       int
+	MinEntropy      float64
+	BreachCorpusDir string // optional directory of Pwned Passwords range files, <PREFIX>.txt
+	Hashing         auth.HasherConfig
+}
+
+// OIDCConfig lists the single sign-on providers, configured per name as OIDC_<NAME>_*
+type OIDCConfig struct {
+	Providers []auth.OIDCProviderConfig
+}
+
 type ClientConfig struct {
 	Environment   string
 	Port          string
+	BaseURL       string
 	SessionSecret string
 	Database      DatabaseConfig
 	Admin         InitialUserConfig
+	Mail          MailConfig
+	WebAuthn      WebAuthnConfig
+	OIDC          OIDCConfig
+	Passwords     PasswordConfig
+	Session       auth.SessionConfig
+	// How long security events are kept; 0 keeps them forever
+	SecurityEventRetention time.Duration
+	// Reverse proxies whose X-Forwarded-For is believed; with none the peer address is used
+	TrustedProxies []*net.IPNet
 }
 
 func loadConfig() (*ClientConfig, error) {
@@ -62,10 +107,33 @@ func loadConfig() (*ClientConfig, error) {
 	viper.SetDefault("POSTGRES_SSL", "disable")
 	viper.SetDefault("POSTGRES_PORT", "5432")
 	viper.SetDefault("SESSION_SECRET", "supersecret")
+	viper.SetDefault("APP_BASE_URL", "http://localhost:8080")
+	viper.SetDefault("MAIL_DRIVER", "log")
+	viper.SetDefault("MAIL_FROM", "no-reply@localhost")
+	viper.SetDefault("SMTP_HOST", "localhost")
+	viper.SetDefault("SMTP_PORT", "1025")
+	viper.SetDefault("WEBAUTHN_RP_ID", "localhost")
+	viper.SetDefault("WEBAUTHN_RP_NAME", "South Texas Farmer")
+	viper.SetDefault("PASSWORD_MIN_LENGTH", 8)
+	viper.SetDefault("PASSWORD_MIN_ENTROPY", 35)
+	hashing := auth.DefaultHasherConfig()
+	viper.SetDefault("PASSWORD_HASH_ALGORITHM", hashing.Algorithm)
+	viper.SetDefault("ARGON2_MEMORY_KIB", hashing.Argon2.Memory)
+	viper.SetDefault("ARGON2_ITERATIONS", hashing.Argon2.Iterations)
+	viper.SetDefault("ARGON2_PARALLELISM", hashing.Argon2.Parallelism)
+	viper.SetDefault("BCRYPT_COST", hashing.BcryptCost)
+	sessions := auth.DefaultSessionConfig()
+	viper.SetDefault("SESSION_IDLE_TIMEOUT", sessions.IdleTimeout)
+	viper.SetDefault("SESSION_ABSOLUTE_TIMEOUT", sessions.AbsoluteTimeout)
+	viper.SetDefault("SESSION_REMEMBER_IDLE_TIMEOUT", sessions.RememberIdleTimeout)
+	viper.SetDefault("SESSION_REMEMBER_ABSOLUTE_TIMEOUT", sessions.RememberAbsoluteTimeout)
+	viper.SetDefault("SESSION_COOKIE_SAMESITE", "strict")
+	viper.SetDefault("SECURITY_EVENT_RETENTION", 365*24*time.Hour)
 
 	// Bind environment variables
 	viper.BindEnv("APP_ENV")
 	viper.BindEnv("APP_PORT")
+	viper.BindEnv("APP_BASE_URL")
 	viper.BindEnv("POSTGRES_HOST")
 	viper.BindEnv("POSTGRES_DB")
 	viper.BindEnv("POSTGRES_USER")
@@ -78,6 +146,34 @@ func loadConfig() (*ClientConfig, error) {
 	viper.BindEnv("ADMIN_PASSWORD")
 	viper.BindEnv("ADMIN_FIRST_NAME")
 	viper.BindEnv("ADMIN_LAST_NAME")
+	viper.BindEnv("MAIL_DRIVER")
+	viper.BindEnv("MAIL_FROM")
+	viper.BindEnv("MAIL_OUTBOX_DIR")
+	viper.BindEnv("SMTP_HOST")
+	viper.BindEnv("SMTP_PORT")
+	viper.BindEnv("SMTP_USERNAME")
+	viper.BindEnv("SMTP_PASSWORD")
+	viper.BindEnv("WEBAUTHN_RP_ID")
+	viper.BindEnv("WEBAUTHN_RP_NAME")
+	viper.BindEnv("WEBAUTHN_RP_ORIGINS")
+	viper.BindEnv("OIDC_PROVIDERS")
+	viper.BindEnv("PASSWORD_MIN_LENGTH")
+	viper.BindEnv("PASSWORD_MIN_ENTROPY")
+	viper.BindEnv("PASSWORD_BREACH_CORPUS")
+	viper.BindEnv("PASSWORD_HASH_ALGORITHM")
+	viper.BindEnv("ARGON2_MEMORY_KIB")
+	viper.BindEnv("ARGON2_ITERATIONS")
+	viper.BindEnv("ARGON2_PARALLELISM")
+	viper.BindEnv("BCRYPT_COST")
+	viper.BindEnv("SESSION_IDLE_TIMEOUT")
+	viper.BindEnv("SESSION_ABSOLUTE_TIMEOUT")
+	viper.BindEnv("SESSION_REMEMBER_IDLE_TIMEOUT")
+	viper.BindEnv("SESSION_REMEMBER_ABSOLUTE_TIMEOUT")
+	viper.BindEnv("SESSION_COOKIE_SECURE")
+	viper.BindEnv("SESSION_COOKIE_SAMESITE")
+	viper.BindEnv("SESSION_COOKIE_DOMAIN")
+	viper.BindEnv("SECURITY_EVENT_RETENTION")
+	viper.BindEnv("TRUSTED_PROXIES")
 
 	// Read the configuration file if it exists
 	if err := viper.ReadInConfig(); err != nil {
@@ -105,18 +201,181 @@ func loadConfig() (*ClientConfig, error) {
 		LastName:  viper.GetString("ADMIN_LAST_NAME"),
 	}
 
+	mail := &MailConfig{
+		Driver:    viper.GetString("MAIL_DRIVER"),
+		Host:      viper.GetString("SMTP_HOST"),
+		Port:      viper.GetString("SMTP_PORT"),
+		Username:  viper.GetString("SMTP_USERNAME"),
+		Password:  viper.GetString("SMTP_PASSWORD"),
+		From:      viper.GetString("MAIL_FROM"),
+		OutboxDir: viper.GetString("MAIL_OUTBOX_DIR"),
+	}
+
+	// Passkeys are only accepted from the public origin unless others are listed
+	origins := strings.Split(viper.GetString("WEBAUTHN_RP_ORIGINS"), ",")
+	if viper.GetString("WEBAUTHN_RP_ORIGINS") == "" {
+		origins = []string{viper.GetString("APP_BASE_URL")}
+	}
+	webAuthn := &WebAuthnConfig{
+		RPID:    viper.GetString("WEBAUTHN_RP_ID"),
+		RPName:  viper.GetString("WEBAUTHN_RP_NAME"),
+		Origins: origins,
+	}
+
+	// Each provider in OIDC_PROVIDERS (e.g. "google,dex") reads OIDC_<NAME>_ISSUER, _CLIENT_ID,
+	// _CLIENT_SECRET, _DISPLAY_NAME, _SCOPES, _ALLOW_SIGNUP, _ALLOWED_DOMAINS and _TRUST_EMAIL
+	oidc := &OIDCConfig{}
+	for _, name := range splitList(viper.GetString("OIDC_PROVIDERS")) {
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		for _, key := range []string{"ISSUER", "CLIENT_ID", "CLIENT_SECRET", "DISPLAY_NAME", "SCOPES", "ALLOW_SIGNUP", "ALLOWED_DOMAINS", "TRUST_EMAIL"} {
+			viper.BindEnv(prefix + key)
+		}
+		viper.SetDefault(prefix+"SCOPES", "profile,email")
+		oidc.Providers = append(oidc.Providers, auth.OIDCProviderConfig{
+			Name:           name,
+			DisplayName:    viper.GetString(prefix + "DISPLAY_NAME"),
+			IssuerURL:      viper.GetString(prefix + "ISSUER"),
+			ClientID:       viper.GetString(prefix + "CLIENT_ID"),
+			ClientSecret:   viper.GetString(prefix + "CLIENT_SECRET"),
+			Scopes:         splitList(viper.GetString(prefix + "SCOPES")),
+			AllowSignup:    viper.GetBool(prefix + "ALLOW_SIGNUP"),
+			AllowedDomains: splitList(viper.GetString(prefix + "ALLOWED_DOMAINS")),
+			TrustEmail:     viper.GetBool(prefix + "TRUST_EMAIL"),
+		})
+	}
+
+	hashing.Algorithm = viper.GetString("PASSWORD_HASH_ALGORITHM")
+	hashing.Argon2.Memory = viper.GetUint32("ARGON2_MEMORY_KIB")
+	hashing.Argon2.Iterations = viper.GetUint32("ARGON2_ITERATIONS")
+	hashing.Argon2.Parallelism = uint8(viper.GetUint("ARGON2_PARALLELISM"))
+	hashing.BcryptCost = viper.GetInt("BCRYPT_COST")
+	passwords := &PasswordConfig{
+		MinLength:       viper.GetInt("PASSWORD_MIN_LENGTH"),
+		MinEntropy:      viper.GetFloat64("PASSWORD_MIN_ENTROPY"),
+		BreachCorpusDir: viper.GetString("PASSWORD_BREACH_CORPUS"),
+		Hashing:         hashing,
+	}
+
+	// Cookies are HTTPS-only everywhere but a development machine
+	viper.SetDefault("SESSION_COOKIE_SECURE", viper.GetString("APP_ENV") != "development")
+	sameSite, err := parseSameSite(viper.GetString("SESSION_COOKIE_SAMESITE"))
+	if err != nil {
+		return nil, err
+	}
+	sessions.IdleTimeout = viper.GetDuration("SESSION_IDLE_TIMEOUT")
+	sessions.AbsoluteTimeout = viper.GetDuration("SESSION_ABSOLUTE_TIMEOUT")
+	sessions.RememberIdleTimeout = viper.GetDuration("SESSION_REMEMBER_IDLE_TIMEOUT")
+	sessions.RememberAbsoluteTimeout = viper.GetDuration("SESSION_REMEMBER_ABSOLUTE_TIMEOUT")
+	sessions.CookieSecure = viper.GetBool("SESSION_COOKIE_SECURE")
+	sessions.CookieSameSite = sameSite
+	sessions.CookieDomain = viper.GetString("SESSION_COOKIE_DOMAIN")
+	if sessions.CookieSameSite == http.SameSiteNoneMode && !sessions.CookieSecure {
+		return nil, fmt.Errorf("SESSION_COOKIE_SAMESITE=none requires SESSION_COOKIE_SECURE")
+	}
+
+	trustedProxies, err := parseTrustedProxies(viper.GetString("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, err
+	}
+
 	// Create and populate the config struct using the correct keys
 	config := &ClientConfig{
 		Environment:   viper.GetString("APP_ENV"),
 		Port:          viper.GetString("APP_PORT"),
+		BaseURL:       viper.GetString("APP_BASE_URL"),
 		SessionSecret: viper.GetString("SESSION_SECRET"),
 		Database:      *database,
 		Admin:         *admin,
+		Mail:          *mail,
+		WebAuthn:      *webAuthn,
+		OIDC:          *oidc,
+		Passwords:     *passwords,
+		Session:       sessions,
+
+		SecurityEventRetention: viper.GetDuration("SECURITY_EVENT_RETENTION"),
+		TrustedProxies:         trustedProxies,
 	}
 
 	return config, nil
 }
 
+// splitList splits a comma-separated setting, dropping blanks
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseSameSite reads a SameSite cookie setting: strict, lax or none
+func parseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("invalid SESSION_COOKIE_SAMESITE %q, expected strict, lax or none", value)
+}
+
+// parseTrustedProxies reads a comma-separated list of proxy addresses or CIDR ranges
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, item := range splitList(value) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q", item)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q: %w", item, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// ipExtractor decides where the client address comes from. Forwarding headers are only
+// believed from the configured proxies, since anyone can send them; without proxies the
+// address of the connection itself is used.
+func ipExtractor(proxies []*net.IPNet) echo.IPExtractor {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range proxies {
+		options = append(options, echo.TrustIPRange(proxy))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// NewMailer builds the configured mailer, falling back to the log outbox
+func NewMailer(cfg MailConfig) mailer.Mailer {
+	if cfg.Driver == "smtp" {
+		return mailer.NewSMTPMailer(mailer.SMTPConfig{
+			Host:     cfg.Host,
+			Port:     cfg.Port,
+			Username: cfg.Username,
+			Password: cfg.Password,
+			From:     cfg.From,
+		})
+	}
+	return mailer.NewOutboxMailer(cfg.From, cfg.OutboxDir)
+}
+
 // BuildPostgreSQLConnectionString creates a PostgreSQL connection string with SSL mode option
 func BuildPostgreSQLConnectionString(host, database, user, password, port, sslMode string) string {
 	encodedPassword := url.QueryEscape(password)
@@ -126,7 +385,7 @@ func BuildPostgreSQLConnectionString(host, database, user, password, port, sslMo
 }
 
 // InitializeUsers creates initial users if enabled and if no users exist
-func InitializeUser(ctx context.Context, queries *database.Queries, cfg InitialUserConfig) error {
+func InitializeUser(ctx context.Context, queries *database.Queries, cfg InitialUserConfig, policy auth.PasswordPolicy, hasher *auth.PasswordHasher) error {
 
 	// Check if any users already exist
 	userCount, err := queries.CountActiveUsers(ctx)
@@ -153,8 +412,15 @@ func InitializeUser(ctx context.Context, queries *database.Queries, cfg InitialU
 		return nil
 	}
 
+	// Stored the way every other create path stores usernames
+	cfg.Username = auth.NormalizeUsername(cfg.Username)
+
+	if msg := policy.Check(cfg.Password, cfg.Username, cfg.Email); msg != "" {
+		return fmt.Errorf("initial user password rejected: %s", msg)
+	}
+
 	// Create each user
-	hashedPassword, err := auth.HashPassword(cfg.Password)
+	hashedPassword, err := hasher.Hash(cfg.Password)
 	if err != nil {
 		slog.Error("failed to hash initial user password", slog.Any("error", err))
 	}
@@ -170,6 +436,18 @@ func InitializeUser(ctx context.Context, queries *database.Queries, cfg InitialU
 	}
 	log.Printf("Successfully created user: %s (%s)", adminUser.Username, adminUser.Email)
 
+	// The bootstrap user is configured by the operator, so there is no address to confirm
+	if err := queries.VerifyUser(ctx, adminUser.ID); err != nil {
+		return fmt.Errorf("failed to verify user: %w", err)
+	}
+
+	if _, err := queries.AssignUserRole(ctx, database.AssignUserRoleParams{
+		UserID:   adminUser.ID,
+		RoleName: auth.RoleAdmin,
+	}); err != nil {
+		return fmt.Errorf("failed to assign admin role: %w", err)
+	}
+
 	return nil
 }
 
@@ -193,17 +471,41 @@ func main() {
 		slog.Error("migrations failed", slog.Any("error", err))
 	}
 
+	// Password hashing, timed once so a badly tuned cost shows up in the logs
+	passwordHasher, err := auth.NewPasswordHasher(cfg.Passwords.Hashing)
+	if err != nil {
+		log.Fatalf("failed to configure password hashing: %s", err)
+	}
+	if _, err := passwordHasher.Benchmark(); err != nil {
+		log.Fatalf("failed to benchmark password hashing: %s", err)
+	}
+
+	// Password policy, optionally backed by an offline breached password corpus
+	passwordPolicy := auth.DefaultPasswordPolicy()
+	passwordPolicy.MaxLength = passwordHasher.MaxPasswordLength()
+	passwordPolicy.MinLength = cfg.Passwords.MinLength
+	passwordPolicy.MinEntropy = cfg.Passwords.MinEntropy
+	if cfg.Passwords.BreachCorpusDir != "" {
+		passwordPolicy.Breaches, err = auth.OpenBreachCorpus(cfg.Passwords.BreachCorpusDir)
+		if err != nil {
+			log.Fatalf("failed to load breached passwords: %s", err)
+		}
+	}
+
 	// Initialize admin user
-	err = InitializeUser(context.Background(), db.Queries, cfg.Admin)
+	err = InitializeUser(context.Background(), db.Queries, cfg.Admin, passwordPolicy, passwordHasher)
 	if err != nil {
 		slog.Error("failed to create initial user", slog.Any("error", err))
 	}
 
 	e := echo.New()
+	// Login throttles, sessions and security events all key on the client address
+	e.IPExtractor = ipExtractor(cfg.TrustedProxies)
 
 	// Middleware
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
+	e.Use(auth.RequestInfoMiddleware())
 
 	// Session middleware - configure with your session store
 	store, err := pgstore.NewPGStore(connectionString, []byte(cfg.SessionSecret))
@@ -211,29 +513,96 @@ func main() {
 		slog.Error("failed to create session store", slog.Any("error", err))
 	}
 	defer store.Close()
+	// Signed cookies are rejected once older than the store's MaxAge, so it must cover the
+	// longest login; startSession shortens each login's own cookie to fit
+	store.Options = cfg.Session.CookieOptions("/", max(cfg.Session.AbsoluteTimeout, cfg.Session.RememberAbsoluteTimeout))
 	e.Use(session.Middleware(store))
 
+	// Every state-changing request must carry the session's CSRF token, except API token calls
+	e.Use(auth.CSRFMiddleware())
+
 	// Initialize services
-	authService := auth.NewAuthService(db.Queries)
-	authHandlers := auth.NewAuthHandlers(authService)
+	authService := auth.NewAuthService(db.Queries, NewMailer(cfg.Mail), auth.Config{
+		BaseURL:   cfg.BaseURL,
+		SecretKey: []byte(cfg.SessionSecret),
+		Passwords: passwordPolicy,
+		Hasher:    passwordHasher,
+		Sessions:  cfg.Session,
+	})
+	passkeys, err := auth.NewPasskeyService(db.Queries, auth.RelyingPartyConfig{
+		ID:          cfg.WebAuthn.RPID,
+		DisplayName: cfg.WebAuthn.RPName,
+		Origins:     cfg.WebAuthn.Origins,
+	}, []byte(cfg.SessionSecret))
+	if err != nil {
+		log.Fatalf("failed to configure passkeys: %s", err)
+	}
+	oidc, err := auth.NewOIDCService(db.Queries, authService, cfg.BaseURL, cfg.OIDC.Providers)
+	if err != nil {
+		log.Fatalf("failed to configure single sign-on: %s", err)
+	}
+	authHandlers := auth.NewAuthHandlers(authService, passkeys, oidc)
+
+	// Prune old security events once a day. The job takes its own connection from the pool
+	// and is stopped before the pool is closed.
+	if cfg.SecurityEventRetention > 0 {
+		retentionCtx, stopRetention := context.WithCancel(context.Background())
+		defer stopRetention()
+		go authService.RunSecurityEventRetention(retentionCtx, cfg.SecurityEventRetention, 24*time.Hour)
+	}
 
 	// Public routes (guests only)
-	guest := e.Group("", auth.GuestOnlyMiddleware())
+	guest := e.Group("", auth.GuestOnlyMiddleware(authService))
 	guest.GET("/login", authHandlers.ShowLogin)
 	guest.POST("/login", authHandlers.Login)
+	guest.GET("/login/2fa", authHandlers.ShowTwoFactorLogin)
+	guest.POST("/login/2fa", authHandlers.TwoFactorLogin)
+	guest.GET("/login/passkey", authHandlers.ShowPasskeyLogin)
+	guest.POST("/login/passkey/begin", authHandlers.BeginPasskeyLogin)
+	guest.POST("/login/passkey/finish", authHandlers.FinishPasskeyLogin)
+	guest.GET("/register", authHandlers.ShowRegister)
+	guest.POST("/register", authHandlers.Register)
+	guest.GET("/forgot-password", authHandlers.ShowForgotPassword)
+	guest.POST("/forgot-password", authHandlers.ForgotPassword)
+	guest.GET("/reset-password", authHandlers.ShowResetPassword)
+	guest.POST("/reset-password", authHandlers.ResetPassword)
 
 	// Public routes (no restrictions)
 	e.GET("/", func(c echo.Context) error {
 		return c.String(http.StatusOK, "Welcome! Go to /login to authenticate.")
 	})
+	e.GET("/verify-email", authHandlers.VerifyEmail)
+
+	// Single sign-on. The callback also finishes linking, started from /settings/identities.
+	guest.GET("/auth/oidc/:provider", authHandlers.BeginOIDCLogin)
+	e.GET("/auth/oidc/:provider/callback", authHandlers.OIDCCallback)
 
 	// Protected routes
-	protected := e.Group("", auth.AuthMiddleware())
+	protected := e.Group("", auth.AuthMiddleware(authService))
+	// Admins viewing the site as another user cannot change that user's sign-in methods
+	notImpersonating := auth.NotWhileImpersonatingMiddleware()
 	protected.GET("/dashboard", auth.Dashboard)
 	protected.POST("/logout", authHandlers.Logout)
-
-	// API routes (protected)
-	api := e.Group("/api", auth.AuthMiddleware())
+	protected.GET("/verify-email/pending", authHandlers.ShowVerificationPending)
+	protected.POST("/verify-email/resend", authHandlers.ResendVerification)
+	protected.GET("/settings/2fa", authHandlers.ShowTwoFactorSettings)
+	protected.POST("/settings/2fa/enroll", authHandlers.EnrollTwoFactor, notImpersonating)
+	protected.POST("/settings/2fa/confirm", authHandlers.ConfirmTwoFactor, notImpersonating)
+	protected.POST("/settings/2fa/recovery-codes", authHandlers.RegenerateRecoveryCodes, notImpersonating)
+	protected.POST("/settings/2fa/disable", authHandlers.DisableTwoFactor, notImpersonating)
+	protected.GET("/settings/passkeys", authHandlers.ShowPasskeys)
+	protected.GET("/settings/tokens", authHandlers.ShowAPITokens)
+	protected.GET("/settings/sessions", authHandlers.ShowSessions)
+	protected.POST("/settings/sessions/revoke-all", authHandlers.RevokeAllSessions, notImpersonating)
+	protected.POST("/settings/sessions/:id/revoke", authHandlers.RevokeSession, notImpersonating)
+	protected.GET("/settings/identities", authHandlers.ShowIdentities)
+	protected.GET("/settings/identities/link/:provider", authHandlers.BeginOIDCLink, notImpersonating)
+	protected.POST("/settings/identities/:id/unlink", authHandlers.UnlinkIdentity, notImpersonating)
+	protected.POST("/impersonation/stop", authHandlers.StopImpersonation)
+	protected.GET("/admin/users", authHandlers.ShowAdminUsers, auth.RequireVerifiedMiddleware(), auth.RequirePermission(auth.PermUsersManage))
+
+	// API routes (protected, verified users only). Accepts a session cookie or an API token.
+	api := e.Group("/api", auth.APIAuthMiddleware(authService), auth.RequireVerifiedMiddleware())
 	api.GET("/profile", func(c echo.Context) error {
 		user, err := auth.GetCurrentUser(c)
 		if err != nil {
@@ -241,9 +610,62 @@ func main() {
 				"error": "Failed to get user info",
 			})
 		}
-		return c.JSON(http.StatusOK, user)
+		return c.JSON(http.StatusOK, auth.NewUserResponse(*user))
 	})
 
+	// Sign-in methods can only be managed from a browser session, never with an API token
+	requireSession := auth.RequireSessionMiddleware()
+	api.GET("/passkeys", authHandlers.ListPasskeys, requireSession)
+	api.POST("/passkeys/register/begin", authHandlers.BeginPasskeyRegistration, requireSession, notImpersonating)
+	api.POST("/passkeys/register/finish", authHandlers.FinishPasskeyRegistration, requireSession, notImpersonating)
+	api.PATCH("/passkeys/:id", authHandlers.RenamePasskey, requireSession, notImpersonating)
+	api.DELETE("/passkeys/:id", authHandlers.RemovePasskey, requireSession, notImpersonating)
+	api.GET("/tokens", authHandlers.ListAPITokens, requireSession)
+	api.POST("/tokens", authHandlers.CreateAPIToken, requireSession, notImpersonating)
+	api.DELETE("/tokens/:id", authHandlers.RevokeAPIToken, requireSession, notImpersonating)
+
+	// Role administration
+	roles := api.Group("/admin", auth.RequirePermission(auth.PermRolesManage))
+	roles.GET("/roles", authHandlers.ListRoles)
+	roles.POST("/roles", authHandlers.CreateRole)
+	roles.DELETE("/roles/:role", authHandlers.DeleteRole)
+	roles.PUT("/roles/:role/permissions/:permission", authHandlers.GrantRolePermission)
+	roles.DELETE("/roles/:role/permissions/:permission", authHandlers.RevokeRolePermission)
+	roles.GET("/permissions", authHandlers.ListPermissions)
+	roles.GET("/users/:id/roles", authHandlers.ListUserRoles)
+	roles.PUT("/users/:id/roles/:role", authHandlers.AssignUserRole)
+	roles.DELETE("/users/:id/roles/:role", authHandlers.RemoveUserRole)
+
+	// User administration
+	users := api.Group("/admin/users", auth.RequirePermission(auth.PermUsersManage))
+	users.GET("", authHandlers.ListUsers)
+	users.GET("/identity-conflicts", authHandlers.ListIdentityConflicts)
+	users.POST("", authHandlers.CreateUser)
+	users.GET("/:id", authHandlers.GetUser)
+	users.PATCH("/:id", authHandlers.UpdateUser)
+	users.POST("/:id/deactivate", authHandlers.DeactivateUser)
+	users.POST("/:id/reactivate", authHandlers.ReactivateUser)
+	users.POST("/:id/verify", authHandlers.ForceVerifyUser)
+	users.POST("/:id/password", authHandlers.AdminResetPassword, notImpersonating)
+	users.POST("/:id/unlock", authHandlers.UnlockUser)
+	users.DELETE("/:id/sessions", authHandlers.AdminRevokeUserSessions)
+	users.POST("/:id/impersonate", authHandlers.StartImpersonation, requireSession, auth.RequirePermission(auth.PermUsersImpersonate))
+
+	// Sessions across all users
+	allSessions := api.Group("/admin/sessions", auth.RequirePermission(auth.PermUsersManage))
+	allSessions.GET("", authHandlers.ListAllSessions)
+	allSessions.DELETE("/:id", authHandlers.AdminRevokeSession)
+
+	// Login lockouts
+	lockouts := api.Group("/admin/lockouts", auth.RequirePermission(auth.PermUsersManage))
+	lockouts.GET("", authHandlers.ListLoginLockouts)
+	lockouts.DELETE("/:scope/:key", authHandlers.UnlockLogin)
+
+	// Security event log
+	securityEvents := api.Group("/admin/security-events", auth.RequirePermission(auth.PermAuditRead))
+	securityEvents.GET("", authHandlers.ListSecurityEvents)
+	securityEvents.GET("/export", authHandlers.ExportSecurityEvents)
+
 	if err := e.Start(":8080"); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}